@@ -3,7 +3,6 @@ package geerpc
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"geerpc/codec"
@@ -90,11 +89,15 @@ type Client struct {
 	seq     uint64
 	pending map[uint64]*Call // [seq: *Call]
 
-	closing  bool // 用来表示用户主动关闭的字段
-	shutdown bool // 用来表示服务端告诉我们关闭的字段
+	closing  bool  // 用来表示用户主动关闭的字段
+	shutdown bool  // 用来表示服务端告诉我们关闭的字段
+	draining bool  // 收到了服务端的 GOAWAY，不再发新的请求，只等已经发出的请求的响应
+	rejected error // 服务端拒绝了握手的原因，之后的调用都返回它
 
 	sending sync.Mutex // 用来保持发送同步的锁
 	mu      sync.Mutex // 用在各种需要同步的地方
+
+	invoker UnaryInvoker // 经过 opt.Interceptors 之后再调用 invoke，没有拦截器时就是 invoke
 }
 
 func (c *Client) Close() error {
@@ -111,7 +114,15 @@ var _ io.Closer = (*Client)(nil)
 func (c *Client) IsAvailable() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return !c.closing && !c.shutdown
+	return !c.closing && !c.shutdown && !c.draining
+}
+
+// IsDraining 是否收到了服务端的 GOAWAY。这样的客户端不能再用来调用了，但还在等已经发出的调用的响应，
+// 不要急着 Close 它，服务端处理完之后会关闭连接，客户端随之关闭
+func (c *Client) IsDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining && !c.shutdown
 }
 
 // 客户端的行为是什么样？
@@ -121,12 +132,18 @@ func (c *Client) IsAvailable() bool {
 
 // Call 表示一次远程方法的调用
 type Call struct {
-	Seq           uint64      // 调用序号
+	Seq           uint64      // 调用序号，有拦截器时为 0（见 Go）
 	ServiceMethod string      // 服务.方法
 	Args          interface{} // 参数
 	Reply         interface{} // 返回结果
 	Error         error       // 调用过程中出现的错误
 	Done          chan *Call  // 用来实现异步请求的工具
+
+	ReplyMetadata map[string]string // 服务端在响应中带回的元数据
+
+	// 元数据和超时时间只能通过 Call 方法的 ctx 设置（见 invoke），Go 发出的请求不带它们
+	metadata map[string]string // 请求带上的元数据
+	timeout  time.Duration     // 请求带上的超时时间，服务端据此设置处理的截止时间，0 表示不限
 }
 
 func (c *Call) done() {
@@ -141,7 +158,10 @@ func (c *Client) registerCall(call *Call) (uint64, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	// 注册之前，判断一下客户端的状态
-	if c.shutdown || c.closing {
+	if c.rejected != nil {
+		return 0, c.rejected
+	}
+	if c.shutdown || c.closing || c.draining {
 		log.Printf("rpc client: registerCall: %s", ErrShutdown.Error())
 		return 0, ErrShutdown
 	}
@@ -199,6 +219,8 @@ func (c *Client) send(call *Call) {
 	c.header.Seq = seq
 	c.header.ServiceMethod = call.ServiceMethod
 	c.header.Error = ""
+	c.header.Metadata = call.metadata
+	c.header.Timeout = call.timeout
 	// 3.2 编码并发送
 	if err := c.cc.Write(&c.header, call.Args); err != nil {
 		call := c.removeCall(seq)
@@ -210,18 +232,46 @@ func (c *Client) send(call *Call) {
 	}
 }
 
-func (c *Client) receive() {
+// cancelCall 调用方不再等 seq 的结果了：把它从 pending 中移除，并发一个取消帧，让服务端别再处理了。
+// 取消帧的 ServiceMethod 是空的，不认识取消帧的老服务端会回一个找不到服务的错误，客户端收到后直接丢掉，不会有影响
+func (c *Client) cancelCall(seq uint64) {
+	if c.removeCall(seq) == nil { // 已经完成了，或者根本没有发出去
+		return
+	}
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if err := c.cc.Write(&codec.Header{Seq: seq, Cancel: true}, invalidRequest); err != nil {
+		log.Println("rpc client: send cancel fail: ", err)
+	}
+}
+
+func (c *Client) receive(conn net.Conn) {
+	// 先读握手的应答。NewClient 发出握手之后没有等，请求可能已经跟着发出去了，被拒绝的话它们都以拒绝的原因结束
+	err := c.readHandshakeReply(conn)
+	if err != nil {
+		log.Println("rpc client: option err: ", err)
+	}
 	// 死循环接收请求
-	var err error
 	for err == nil {
 		// 1. 先读头
 		header := &codec.Header{}
-		if err := c.cc.ReadHeader(header); err != nil {
+		if err = c.cc.ReadHeader(header); err != nil { // 注意不能用 :=，否则外面的 err 还是 nil，terminateCalls 就拿不到错误了
 			break
 		}
+		if header.GoAway {
+			// 服务端要关闭了，之后的调用直接返回 ErrShutdown，已经发出的调用继续等响应
+			c.mu.Lock()
+			c.draining = true
+			c.mu.Unlock()
+			err = c.cc.ReadBody(nil)
+			continue
+		}
 		// 2. 再读体
 		// 拿到头之后，知道了seq，先调用 removeCall 方法移除并得到这个 call
 		call := c.removeCall(header.Seq)
+		if call != nil {
+			call.ReplyMetadata = header.Metadata
+		}
 		switch {
 		case call == nil:
 			// 意味着这个 call 往服务端发送失败了，它已经被移除了
@@ -242,6 +292,29 @@ func (c *Client) receive() {
 	}
 	// 客户端、服务端发送错误时，终结所有 call，并通知错误消息
 	c.terminateCalls(err)
+	c.mu.Lock()
+	draining := c.draining
+	c.mu.Unlock()
+	if draining {
+		// 收到过 GOAWAY 的话，服务端已经关闭了连接，这个客户端不会再用了
+		_ = c.cc.Close()
+	}
+}
+
+// readHandshakeReply 读出服务端对握手的应答。ConnectTimeout 不为 0 的话，应答也要在这个时间内收到
+func (c *Client) readHandshakeReply(conn net.Conn) error {
+	if c.opt.ConnectTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(c.opt.ConnectTimeout))
+	}
+	if err := readHandshakeReply(conn); err != nil {
+		c.mu.Lock()
+		c.rejected = err
+		c.mu.Unlock()
+		_ = conn.Close() // 服务端在等客户端关闭连接（见 closeRejected）
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return nil
 }
 
 // 到此为止，客户端的功能基本完成了。下面再给客户端加上一些方便使用的函数和方法
@@ -250,29 +323,35 @@ func (c *Client) receive() {
 // 1. 通过上面的代码可知，客户端的收发请求都是通过 codec 来完成了，codec 需要“连接”，所以这里的参数之一是“连接”
 // 2. 简易性的原则使得我们想要 new 了一个客户端之后，立马可以收发消息，而不需要事后还要与服务端协商编码。那么这里的参数之二就是用于协商编码的“Option”
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
-	codecFunc := codec.NewCodecFuncMap[opt.CodecType]
-	if codecFunc == nil {
+	codecFunc, ok := codec.Lookup(opt.CodecType)
+	if !ok {
 		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
 		log.Println("rpc client: codec error: ", err)
 		return nil, err
 	}
-	// 协商编码
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println("rpc client: option err: ", err)
-		_ = conn.Close()
+	if !codec.ValidCompression(opt.Compression) {
+		err := fmt.Errorf("invalid compression %s", opt.Compression)
+		log.Println("rpc client: codec error: ", err)
 		return nil, err
 	}
-	// 接收到服务端的确认消息，完成两次握手。如果没有这第二次握手，
-	// 会产生 rpc server: read header error: gob: unknown type id or corrupted data 的粘包问题
+	// 协商编码。最早 Option 是用 json 编码的，会产生 rpc server: read header error: gob: unknown type id or corrupted data 的粘包问题
 	// 		- 当客户端消息发送过快服务端消息积压时（例：Option|Header|Body|Header|Body），
 	//		服务端使用json解析Option，json.Decode()调用conn.read()读取数据到内部的缓冲区（例：Option|Header），
-	//		此时后续的RPC消息就不完整了(Body|Header|Body)。 示例代码中客户端简单的使用time.sleep()方式隔离协议交换阶段与RPC消息阶段，减少这种问题发生的可能。
-	if err := json.NewDecoder(conn).Decode(opt); err != nil {
+	//		此时后续的RPC消息就不完整了(Body|Header|Body)。
+	// 现在换成了二进制的握手，服务端只读握手需要的字节，不会再吞掉后面的消息。
+	// 所以这里发出握手就返回，第一个请求紧跟在握手后面发出去，不用多等一个来回。
+	// 服务端的应答由 receive 读，被拒绝的话已经发出的调用都会返回拒绝的原因
+	if err := writeHandshake(conn, opt); err != nil {
 		log.Println("rpc client: option err: ", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	cc := codecFunc(conn)
+	cc, err := newCodec(codecFunc, conn, opt, opt.MaxMessageSize)
+	if err != nil {
+		log.Println("rpc client: codec error: ", err)
+		_ = conn.Close()
+		return nil, err
+	}
 	c := &Client{
 		cc:       cc,
 		opt:      opt,
@@ -282,8 +361,9 @@ func NewClient(conn net.Conn, opt *Option) (*Client, error) {
 		closing:  false,
 		shutdown: false,
 	}
+	c.invoker = ChainUnaryClient(opt.Interceptors, conn.RemoteAddr().String(), c.invoke)
 	// 更近一步，启动接收协程
-	go c.receive()
+	go c.receive(conn)
 	return c, nil
 }
 
@@ -434,30 +514,77 @@ type newClientFunc func(conn net.Conn, opt *Option) (*Client, error)
 // 通过 Dial 已经能够很方便地连接服务器了。除此之外，我们再来把 send 方法包装一下，因为它的参数有 Call，需要自己构造，不方便
 
 // Go 异步调用。我们发一起一次调用，只需要指定我们的：service.methods、入参、结果。同时，为了支持异步，添加了一个 chan 参数
+// Go 发出的请求不带元数据和截止时间，需要的话在自己的协程里用 Call 方法。两种情况下 Call 完成时 ReplyMetadata 里都是服务端带回的元数据。
+// 有拦截器时，调用链在单独的协程里走完之后再通过 done 通知。拦截器可能重试，一次调用对应多个请求，所以返回的 Call 中 Seq 始终为 0
 func (c *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
-	if done == nil {
-		done = make(chan *Call, 10)
-	} else if cap(done) == 0 {
-		log.Panic("rpc client: done channel is unbuffered")
-	}
 	call := &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
 	}
+	if len(c.opt.Interceptors) == 0 {
+		return c.goCall(call)
+	}
+	if call.Done == nil {
+		call.Done = make(chan *Call, 10)
+	} else if cap(call.Done) == 0 {
+		log.Panic("rpc client: done channel is unbuffered")
+	}
+	go func() {
+		call.Error = c.invoker(WithReplyMetadata(context.Background(), &call.ReplyMetadata), serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+// goCall 发送一个构造好的 Call，Call 会在上面带上元数据和超时时间
+func (c *Client) goCall(call *Call) *Call {
+	if call.Done == nil {
+		call.Done = make(chan *Call, 10)
+	} else if cap(call.Done) == 0 {
+		log.Panic("rpc client: done channel is unbuffered")
+	}
 	c.send(call)
 	return call
 }
 
 // Call 同步调用。只需要在 Go 上面做同步上就好了
-// 给 Call 加上请求超时机制，利用 Context 来做
+// 给 Call 加上请求超时机制，利用 Context 来做。ctx 中通过 WithMetadata 设置的元数据会随请求一起发送，
+// 通过 WithReplyMetadata 可以拿到服务端在响应中带回的元数据。
+// ctx 的截止时间也会随请求一起发给服务端；ctx 结束时除了本地直接返回，还会通知服务端取消这个请求，免得服务端白白处理。
+// Option.Interceptors 中的拦截器会依次包在外面
 func (c *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := c.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	return c.invoker(ctx, serviceMethod, args, reply)
+}
+
+// invoke 调用链的最后一环，真正把请求发出去并等待结果
+func (c *Client) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	if err := ctx.Err(); err != nil { // 已经结束了就不用发了
+		return fmt.Errorf("rpc client: call failed: " + err.Error())
+	}
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+		metadata:      outgoingMetadata(ctx),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		call.timeout = time.Until(deadline)
+		if call.timeout <= 0 { // 0 表示不限，刚好到期的话至少给 1 纳秒
+			call.timeout = 1
+		}
+	}
+	c.goCall(call)
 	select {
-	case <-ctx.Done(): // 调用超时
+	case <-ctx.Done(): // 调用超时或者被取消了
+		c.cancelCall(call.Seq)
 		return fmt.Errorf("rpc client: call failed: " + ctx.Err().Error())
 	case ca := <-call.Done: // 调用完成
+		if md := replyMetadataPtr(ctx); md != nil {
+			*md = ca.ReplyMetadata
+		}
 		return ca.Error
 	}
 }
@@ -2,11 +2,15 @@ package geerpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"geerpc/codec"
 	"net"
 	"strings"
 	"testing"
 	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestClient_dialTimeout(t *testing.T) {
@@ -34,6 +38,36 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+func (b Bar) Double(argv int, reply *int) error {
+	*reply = argv * 2
+	return nil
+}
+
+// Repeat 返回 n 个字节的字符串，用来构造很大的响应
+func (b Bar) Repeat(n int, reply *string) error {
+	*reply = strings.Repeat("x", n)
+	return nil
+}
+
+func (b Bar) Echo(args *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+	reply.Value = "echo: " + args.GetValue()
+	return nil
+}
+
+// Length 参数是 proto.Message，返回值不是，用 ProtoCodec 调用时响应编码不了
+func (b Bar) Length(args *wrapperspb.StringValue, reply *int) error {
+	*reply = len(args.GetValue())
+	return nil
+}
+
+// Whoami 带 context 的方法，把请求的元数据中的 user 返回去，并在响应的元数据中带上 handled-by
+func (b Bar) Whoami(ctx context.Context, argv int, reply *string) error {
+	md, _ := MetadataFromContext(ctx)
+	*reply = md["user"]
+	SetReplyMetadata(ctx, "handled-by", "bar")
+	return nil
+}
+
 func startServer(addr chan string) {
 	bar := new(Bar)
 	Register(bar)
@@ -50,7 +84,8 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		replyv := new(int)
 		err := client.Call(ctx, "Bar.Timeout", 1, replyv)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
@@ -61,6 +96,124 @@ func TestClient_Call(t *testing.T) {
 		err := client.Call(context.Background(), "Bar.Timeout", 1, replyv)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
 	})
+	t.Run("server error keeps the client alive", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &Option{CodecType: codec.TlvType})
+		replyv := new(int)
+		for i := 0; i < 2; i++ {
+			err := client.Call(context.Background(), "Bar.NotExist", 1, replyv)
+			_assert(err != nil && strings.Contains(err.Error(), "can't find methods"), "expect a method not found error")
+		}
+		_assert(client.IsAvailable(), "client should still be available")
+	})
+	t.Run("msgpack", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &Option{CodecType: codec.MsgpackType})
+		reply := new(int)
+		err := client.Call(context.Background(), "Bar.Double", 21, reply)
+		_assert(err == nil && *reply == 42, "unexpected reply: %d, %v", *reply, err)
+	})
+	t.Run("protobuf", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &Option{CodecType: codec.ProtoType})
+		reply := &wrapperspb.StringValue{}
+		err := client.Call(context.Background(), "Bar.Echo", wrapperspb.String("hi"), reply)
+		_assert(err == nil && reply.GetValue() == "echo: hi", "unexpected reply: %v, %v", reply, err)
+		err = client.Call(context.Background(), "Bar.Echo", "not a proto message", reply)
+		_assert(errors.Is(err, codec.ErrNotProtoMessage), "expect ErrNotProtoMessage, got %v", err)
+		_assert(client.IsAvailable(), "client should still be available")
+	})
+	t.Run("protobuf non-proto reply", func(t *testing.T) {
+		// 返回值编码失败时服务端把错误发回来，客户端不会一直等着
+		for _, framing := range []bool{false, true} {
+			client, _ := Dial("tcp", addr, &Option{CodecType: codec.ProtoType, Framing: framing})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := client.Call(ctx, "Bar.Length", wrapperspb.String("hi"), new(int))
+			cancel()
+			_assert(err != nil && strings.Contains(err.Error(), codec.ErrNotProtoMessage.Error()), "expect ErrNotProtoMessage with framing %v, got %v", framing, err)
+			_assert(client.IsAvailable(), "client should still be available with framing %v", framing)
+			_ = client.Close()
+		}
+	})
+	t.Run("compression", func(t *testing.T) {
+		for _, c := range []codec.Compression{codec.CompressGzip, codec.CompressSnappy, codec.CompressZstd} {
+			client, err := Dial("tcp", addr, &Option{CodecType: codec.TlvType, Compression: c, CompressThreshold: 1})
+			_assert(err == nil, "dial with %s: %v", c, err)
+			reply := new(int)
+			err = client.Call(context.Background(), "Bar.Double", 21, reply)
+			_assert(err == nil && *reply == 42, "unexpected reply with %s: %d, %v", c, *reply, err)
+		}
+		_, err := Dial("tcp", addr, &Option{Compression: "lz4"})
+		_assert(err != nil, "expect an error for unsupported compression")
+	})
+	t.Run("metadata", func(t *testing.T) {
+		for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.TlvType, codec.MsgpackType} {
+			client, err := Dial("tcp", addr, &Option{CodecType: typ})
+			_assert(err == nil, "dial with %s: %v", typ, err)
+			var reply string
+			var replyMD map[string]string
+			ctx := WithMetadata(context.Background(), map[string]string{"user": "alice", "trace-id": "1"})
+			ctx = WithReplyMetadata(ctx, &replyMD)
+			err = client.Call(ctx, "Bar.Whoami", 1, &reply)
+			_assert(err == nil && reply == "alice", "unexpected reply with %s: %q, %v", typ, reply, err)
+			_assert(len(replyMD) == 1 && replyMD["handled-by"] == "bar", "unexpected reply metadata with %s: %v", typ, replyMD)
+			// 没有带元数据的请求，服务端拿到的也是空的
+			err = client.Call(context.Background(), "Bar.Whoami", 1, &reply)
+			_assert(err == nil && reply == "", "unexpected reply with %s: %q, %v", typ, reply, err)
+			// Go 发出的请求也不带元数据，响应的元数据放在 Call 里
+			call := <-client.Go("Bar.Whoami", 1, &reply, nil).Done
+			_assert(call.Error == nil && call.Seq != 0 && reply == "" && call.ReplyMetadata["handled-by"] == "bar", "unexpected async call with %s: %+v", typ, call)
+		}
+	})
+	t.Run("interceptors", func(t *testing.T) {
+		var addrs []string
+		// 第一次调用失败时重试一次
+		retry := func(ctx context.Context, info *UnaryClientInfo, args, reply interface{}, invoker UnaryInvoker) error {
+			addrs = append(addrs, info.Addr)
+			if err := invoker(ctx, info.ServiceMethod, args, reply); err == nil || info.ServiceMethod != "Bar.NotExist" {
+				return err
+			}
+			return invoker(ctx, "Bar.Whoami", args, reply)
+		}
+		// 统一带上 user，没有参数的调用直接拒绝
+		auth := func(ctx context.Context, info *UnaryClientInfo, args, reply interface{}, invoker UnaryInvoker) error {
+			if args == nil {
+				return errors.New("args required")
+			}
+			if info.Metadata["user"] == "" {
+				ctx = WithMetadata(ctx, map[string]string{"user": "bob"})
+			}
+			return invoker(ctx, info.ServiceMethod, args, reply)
+		}
+		client, err := Dial("tcp", addr, &Option{CodecType: codec.JsonType, Interceptors: []UnaryClientInterceptor{retry, auth}})
+		_assert(err == nil, "dial: %v", err)
+		defer client.Close()
+		var reply string
+		err = client.Call(context.Background(), "Bar.NotExist", 1, &reply)
+		_assert(err == nil && reply == "bob", "expect the retry to succeed: %q, %v", reply, err)
+		port := addr[strings.LastIndex(addr, ":"):] // 监听的是 [::]，连上的地址只能比较端口
+		_assert(len(addrs) == 1 && strings.HasSuffix(addrs[0], port), "unexpected addrs: %v", addrs)
+		ctx := WithMetadata(context.Background(), map[string]string{"user": "alice"})
+		err = client.Call(ctx, "Bar.Whoami", 1, &reply)
+		_assert(err == nil && reply == "alice", "unexpected reply: %q, %v", reply, err)
+		err = client.Call(context.Background(), "Bar.Whoami", nil, &reply)
+		_assert(err != nil && err.Error() == "args required", "expect the call to be rejected, got %v", err)
+		call := <-client.Go("Bar.Whoami", 1, &reply, nil).Done
+		_assert(call.Error == nil && call.Seq == 0 && reply == "bob" && call.ReplyMetadata["handled-by"] == "bar", "unexpected async call: %+v", call)
+	})
+	t.Run("framing", func(t *testing.T) {
+		for _, opt := range []*Option{
+			{CodecType: codec.GobType, Framing: true},
+			{CodecType: codec.JsonType, Framing: true},
+			{CodecType: codec.TlvType, Framing: true, Compression: codec.CompressSnappy, CompressThreshold: 1},
+		} {
+			client, err := Dial("tcp", addr, opt)
+			_assert(err == nil, "dial with %+v: %v", opt, err)
+			reply := new(int)
+			// 找不到方法时服务端直接跳过 Body，之后的请求不受影响
+			err = client.Call(context.Background(), "Bar.NotExist", 1, reply)
+			_assert(err != nil && strings.Contains(err.Error(), "can't find methods"), "expect a method not found error")
+			err = client.Call(context.Background(), "Bar.Double", 21, reply)
+			_assert(err == nil && *reply == 42, "unexpected reply with %+v: %d, %v", opt, *reply, err)
+		}
+	})
 }
 
 func _assert(condition bool, msg string, v ...interface{}) {
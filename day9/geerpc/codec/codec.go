@@ -1,7 +1,12 @@
 package codec
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"sync"
+	"time"
+	"tlv/wire"
 )
 
 // 1. 在 codec.go 中
@@ -12,11 +17,19 @@ import (
 // ServiceMethod 是服务名和方法名，通常与 Go 语言中的结构体和方法相映射。
 // Seq 是请求的序号，也可以认为是某个请求的 ID，用来区分不同的请求。
 // Error 是错误信息，客户端置为空，服务端如果如果发生错误，将错误信息置于 Error 中。
+// Metadata 是请求和响应附带的元数据，比如请求 ID、鉴权的 token、租户 ID、链路追踪的上下文，没有的时候为 nil。
+// Timeout 是客户端还愿意等多久，服务端据此设置处理的截止时间。用相对时间而不是绝对时间，两边的时钟不一致也没关系，0 表示不限。
+// Cancel 为 true 表示这是一个取消帧：客户端不再需要 Seq 这个请求的结果了，ServiceMethod 为空，Body 为空。
+// GoAway 为 true 表示服务端要关闭了：客户端不要再在这个连接上发新的请求，已经发出的请求仍然会收到响应。Seq 为 0，Body 为空。
 // 注意与 Http 协议的请求头区分开来
 type Header struct {
 	ServiceMethod string
 	Seq           uint64
 	Error         string
+	Metadata      map[string]string `json:",omitempty" msgpack:",omitempty"`
+	Timeout       time.Duration     `json:",omitempty" msgpack:",omitempty"`
+	Cancel        bool              `json:",omitempty" msgpack:",omitempty"`
+	GoAway        bool              `json:",omitempty" msgpack:",omitempty"`
 }
 
 // Codec 接着抽象出 Codec 解码器接口，解码器就需要对 Header 进行解码
@@ -33,20 +46,60 @@ type NewCodecFunc func(closer io.ReadWriteCloser) Codec
 // Type 类型，根据这个类型可以从 map 里面取对应的构造函数
 type Type string
 
-// 定义两个默认类型。这个例子中只实现了 Gob 的 Codec，所以只用到了 GobType
+// 定义默认类型。Gob、Json、Tlv、Protobuf、MessagePack 五种 Codec 都已经实现
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json"
-	TlvType  Type = "application/tlv"
+	GobType     Type = "application/gob"
+	JsonType    Type = "application/json"
+	TlvType     Type = wire.TlvType // 握手中用到，和 tlvdump 共用
+	ProtoType   Type = "application/protobuf"
+	MsgpackType Type = "application/msgpack"
 )
 
-// NewCodecFuncMap 存放各种类型的构造函数
-var NewCodecFuncMap map[Type]NewCodecFunc
+// 存放各种类型的构造函数。其他包也可以通过 Register 注册自己的 Codec，所以读写都要加锁
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[Type]NewCodecFunc)
+)
+
+// NewCodecFuncMap 以前存放构造函数的 map，为了兼容老代码还留着，内置的 Codec 都在里面，Register 也会把新注册的放进来。
+// 它只是注册表的一份副本，往里面写不会注册新的 Codec。
+//
+// Deprecated: 这个 map 没有加锁，和 Register 同时读写是不安全的，查找用 Lookup，注册用 Register
+var NewCodecFuncMap = make(map[Type]NewCodecFunc)
 
 func init() {
-	// 初始化 map
-	NewCodecFuncMap = map[Type]NewCodecFunc{
-		GobType: NewGobCodec,
-		TlvType: NewTlvCodec,
+	for typ, f := range map[Type]NewCodecFunc{
+		GobType:     NewGobCodec,
+		JsonType:    NewJsonCodec,
+		TlvType:     NewTlvCodec,
+		ProtoType:   NewProtoCodec,
+		MsgpackType: NewMsgpackCodec,
+	} {
+		if err := Register(typ, f); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register 注册一种 Codec。客户端和服务端在 Option 中协商的就是这里的 typ，同一个 typ 只能注册一次
+func Register(typ Type, f NewCodecFunc) error {
+	if typ == "" || f == nil {
+		return errors.New("rpc codec: codec type and constructor can't be empty")
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[typ]; ok {
+		return fmt.Errorf("rpc codec: codec type %s already registered", typ)
 	}
+	codecs[typ] = f
+	NewCodecFuncMap[typ] = f
+	return nil
+}
+
+// Lookup 根据类型找到 Codec 的构造函数，没有注册过的话 ok 为 false
+func Lookup(typ Type) (f NewCodecFunc, ok bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	f, ok = codecs[typ]
+	return
 }
@@ -0,0 +1,934 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/quick"
+	"time"
+	tlv "tlv/codec"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testArgs struct {
+	Num1, Num2 int
+	Name       string
+}
+
+// roundTrip 用 net.Pipe 模拟一条连接，一端写入 Header + Body，另一端读出来
+func roundTrip(t *testing.T, typ Type, h *Header, body interface{}, out interface{}) *Header {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	newCodec, ok := Lookup(typ)
+	if !ok {
+		t.Fatalf("codec %s doesn't exist", typ)
+	}
+	w, r := newCodec(client), newCodec(server)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- w.Write(h, body)
+	}()
+	got := &Header{}
+	if err := r.ReadHeader(got); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	if err := r.ReadBody(out); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return got
+}
+
+// registerRuns 注册表是全局的，go test -count=n 多次运行时每次注册不同的 Type
+var registerRuns int32
+
+func TestRegister(t *testing.T) {
+	if err := Register(GobType, NewGobCodec); err == nil {
+		t.Fatalf("expect an error for a duplicate codec type")
+	}
+	if err := Register("", NewGobCodec); err == nil {
+		t.Fatalf("expect an error for an empty codec type")
+	}
+	if _, ok := Lookup("application/unknown"); ok {
+		t.Fatalf("unknown codec type shouldn't be found")
+	}
+	// 并发地注册和查找
+	custom := Type("application/x-" + strings.ToLower(t.Name()) + "-" + strconv.Itoa(int(atomic.AddInt32(&registerRuns, 1))))
+	errCh := make(chan error, 8)
+	for i := 0; i < cap(errCh); i++ {
+		go func() {
+			Lookup(GobType)
+			errCh <- Register(custom, NewJsonCodec)
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < cap(errCh); i++ {
+		if <-errCh == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expect exactly one successful registration, got %d", succeeded)
+	}
+	roundTrip(t, custom, &Header{ServiceMethod: "Foo.Sum", Seq: 1}, testArgs{Num1: 1}, nil)
+
+	// 兼容以前的 NewCodecFuncMap：内置的和注册的 Codec 都在里面
+	codecsMu.RLock()
+	gob, registered := NewCodecFuncMap[GobType], NewCodecFuncMap[custom]
+	codecsMu.RUnlock()
+	if gob == nil || registered == nil {
+		t.Fatalf("expect %s and %s in NewCodecFuncMap", GobType, custom)
+	}
+}
+
+// TestHeader_metadata 所有内置的编码方式都能带上元数据、超时时间、取消和 GOAWAY 标记，没有元数据时解码出来还是 nil
+func TestHeader_metadata(t *testing.T) {
+	md := map[string]string{"request-id": "42", "token": "secret", "": "empty key"}
+	for _, typ := range []Type{GobType, JsonType, TlvType, MsgpackType, ProtoType} {
+		t.Run(string(typ), func(t *testing.T) {
+			var body interface{} = testArgs{Num1: 1}
+			if typ == ProtoType {
+				body = wrapperspb.Int64(1)
+			}
+			for _, h := range []*Header{
+				{ServiceMethod: "Foo.Sum", Seq: 1, Metadata: md},
+				{ServiceMethod: "Foo.Sum", Seq: 2},
+				{ServiceMethod: "Foo.Sum", Seq: 3, Timeout: 1500 * time.Millisecond},
+				{Seq: 3, Cancel: true},
+				{GoAway: true},
+			} {
+				got := roundTrip(t, typ, h, body, nil)
+				if !reflect.DeepEqual(got, h) {
+					t.Fatalf("header mismatch: got %#v, want %#v", got, h)
+				}
+			}
+		})
+	}
+}
+
+func TestJsonCodec(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Sum", Seq: 7, Error: "oops"}
+	args := testArgs{Num1: 1, Num2: 2, Name: "geerpc"}
+	var out testArgs
+	got := roundTrip(t, JsonType, h, args, &out)
+	if !reflect.DeepEqual(got, h) {
+		t.Fatalf("header mismatch: got %+v, want %+v", got, h)
+	}
+	if out != args {
+		t.Fatalf("body mismatch: got %+v, want %+v", out, args)
+	}
+}
+
+func TestJsonCodec_discardBody(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Sum", Seq: 1}
+	roundTrip(t, JsonType, h, testArgs{Num1: 1}, nil)
+}
+
+type tlvInner struct {
+	Arg3 int8
+	Tags []string
+}
+
+type tlvArgs struct {
+	Names    []string
+	Empty    []string
+	Nil      []string
+	Scores   map[string]int64
+	NilMap   map[string]int64
+	Inner    *tlvInner
+	NilInner *tlvInner
+	Fixed    [3]uint16
+	Nested   [][]int32
+	Inners   []*tlvInner
+}
+
+func TestTlvCodec_composite(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Sum", Seq: 3}
+	args := tlvArgs{
+		Names:  []string{"a", "bb", ""},
+		Empty:  []string{},
+		Scores: map[string]int64{"x": 1, "y": 300, "z": 1 << 40},
+		Inner:  &tlvInner{Arg3: 9, Tags: []string{"t"}},
+		Fixed:  [3]uint16{1, 2, 65535},
+		Nested: [][]int32{{1, 2}, nil, {}},
+		Inners: []*tlvInner{{Arg3: 1}, nil},
+	}
+	var out tlvArgs
+	got := roundTrip(t, TlvType, h, &args, &out)
+	if !reflect.DeepEqual(got, h) {
+		t.Fatalf("header mismatch: got %+v, want %+v", got, h)
+	}
+	if !reflect.DeepEqual(out, args) {
+		t.Fatalf("body mismatch:\n got %#v\nwant %#v", out, args)
+	}
+	if out.Empty == nil || out.Nil != nil {
+		t.Fatalf("nil and empty slices should be kept apart")
+	}
+}
+
+type tlvScalars struct {
+	Flag    bool
+	Off     bool
+	Amount  float64
+	Rate    float32
+	Z64     complex64
+	Z128    complex128
+	Blob    []byte
+	NilBlob []byte
+	Digest  [4]byte
+}
+
+func TestTlvCodec_scalars(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Pay", Seq: 4}
+	args := tlvScalars{
+		Flag:   true,
+		Amount: 1234.5678,
+		Rate:   -0.25,
+		Z64:    complex(1, -2),
+		Z128:   complex(3.5, 4.25),
+		Blob:   []byte{0, 1, 0x80, 0xff},
+		Digest: [4]byte{0xde, 0xad, 0xbe, 0xef},
+	}
+	var out tlvScalars
+	roundTrip(t, TlvType, h, &args, &out)
+	if !reflect.DeepEqual(out, args) {
+		t.Fatalf("body mismatch:\n got %#v\nwant %#v", out, args)
+	}
+}
+
+func TestTlvCodec_errors(t *testing.T) {
+	var buf bytes.Buffer
+	enc := tlv.NewEncoder(&buf)
+	_ = enc.Encode(&Header{ServiceMethod: "Foo.Sum", Seq: 5})
+	_ = enc.Encode("not a number")
+	_ = enc.Encode(int64(-1))
+	full := buf.Bytes()
+
+	t.Run("type mismatch keeps the stream aligned", func(t *testing.T) {
+		dec := tlv.NewDecoder(bytes.NewReader(full))
+		h := &Header{}
+		if err := dec.Decode(h); err != nil {
+			t.Fatalf("read header: %v", err)
+		}
+		var n int
+		var typeErr *tlv.TypeError
+		if err := dec.Decode(&n); !errors.As(err, &typeErr) {
+			t.Fatalf("expect a *tlv.TypeError, got %v", err)
+		}
+		var u uint32
+		if err := dec.Decode(&u); !errors.As(err, &typeErr) {
+			t.Fatalf("negative value into uint32 should fail, got %v", err)
+		}
+	})
+	t.Run("sign extension", func(t *testing.T) {
+		dec := tlv.NewDecoder(bytes.NewReader(full))
+		_ = dec.Decode(nil)
+		_ = dec.Decode(nil)
+		var n int64
+		if err := dec.Decode(&n); err != nil || n != -1 {
+			t.Fatalf("expect -1, got %d (%v)", n, err)
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		for i := 1; i < len(full); i++ {
+			dec := tlv.NewDecoder(bytes.NewReader(full[:i]))
+			var err error
+			for err == nil {
+				err = dec.Decode(nil)
+			}
+			if err == io.EOF {
+				continue // 恰好在两个 TLV 之间截断
+			}
+			if !errors.Is(err, tlv.ErrTruncated) {
+				t.Fatalf("cut at %d: expect ErrTruncated, got %v", i, err)
+			}
+		}
+	})
+	t.Run("decode bytes", func(t *testing.T) {
+		h := &Header{}
+		var dec tlv.Decoder
+		if err := dec.DecodeBytes(full[:len(full)-3], h); err != nil {
+			t.Fatalf("decode header from bytes: %v", err)
+		}
+		if err := dec.DecodeBytes(full[:3], h); !errors.Is(err, tlv.ErrTruncated) {
+			t.Fatalf("expect ErrTruncated, got %v", err)
+		}
+		if err := dec.DecodeBytes([]byte{0x1f, 0}, h); !errors.Is(err, tlv.ErrUnknownTag) {
+			t.Fatalf("expect ErrUnknownTag, got %v", err)
+		}
+	})
+}
+
+type tlvLarge struct {
+	Blob  []byte
+	Lines []string
+}
+
+func TestTlvCodec_largeFrame(t *testing.T) {
+	args := tlvLarge{Blob: make([]byte, 4<<20)}
+	for i := range args.Blob {
+		args.Blob[i] = byte(i)
+	}
+	for i := 0; i < 100000; i++ {
+		args.Lines = append(args.Lines, "line")
+	}
+	h := &Header{ServiceMethod: "Foo.Upload", Seq: 6}
+	var out tlvLarge
+	roundTrip(t, TlvType, h, &args, &out)
+	if !reflect.DeepEqual(out, args) {
+		t.Fatalf("large body mismatch")
+	}
+
+	// 超过最大帧大小的包直接拒绝
+	var buf bytes.Buffer
+	enc := tlv.NewEncoder(&buf)
+	_ = enc.Encode(&args)
+	_ = enc.Encode(h)
+	data := buf.Bytes()
+	dec := tlv.NewDecoder(bytes.NewReader(data))
+	dec.SetMaxFrameSize(1 << 20)
+	if err := dec.Decode(&out); !errors.Is(err, tlv.ErrLengthOverflow) {
+		t.Fatalf("expect ErrLengthOverflow, got %v", err)
+	}
+	// 大包之后，同一个连接上的小包照样能正常解码
+	dec = tlv.NewDecoder(bytes.NewReader(data))
+	got := &Header{}
+	if err := dec.Decode(&out); err != nil {
+		t.Fatalf("decode large body: %v", err)
+	}
+	if err := dec.Decode(got); err != nil || !reflect.DeepEqual(got, h) {
+		t.Fatalf("decode header after large body: %+v, %v", got, err)
+	}
+}
+
+// 同一个参数结构体的两个版本：v2 调整了字段顺序，删掉了 Legacy，新增了 Extra
+type argsV1 struct {
+	Num1   int    `tlv:"1"`
+	Num2   int    `tlv:"2"`
+	Legacy string `tlv:"3"`
+	Name   string `tlv:"4"`
+}
+
+type argsV2 struct {
+	Name  string   `tlv:"4"`
+	Extra []string `tlv:"5"`
+	Num2  int      `tlv:"2"`
+	Num1  int      `tlv:"1"`
+	Skip  string   `tlv:"-"`
+}
+
+func TestTlvCodec_schemaEvolution(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Sum", Seq: 8}
+	v1 := argsV1{Num1: 1, Num2: -2, Legacy: "old", Name: "geerpc"}
+	var v2 argsV2
+	roundTrip(t, TlvType, h, &v1, &v2)
+	if want := (argsV2{Name: "geerpc", Num2: -2, Num1: 1}); !reflect.DeepEqual(v2, want) {
+		t.Fatalf("v1 -> v2: got %#v, want %#v", v2, want)
+	}
+
+	v2 = argsV2{Name: "new", Extra: []string{"x"}, Num1: 3, Num2: 4, Skip: "local"}
+	var back argsV1
+	roundTrip(t, TlvType, h, &v2, &back)
+	if want := (argsV1{Num1: 3, Num2: 4, Name: "new"}); back != want {
+		t.Fatalf("v2 -> v1: got %#v, want %#v", back, want)
+	}
+}
+
+func TestTlvCodec_duplicateFieldNumber(t *testing.T) {
+	type bad struct {
+		A int `tlv:"1"`
+		B int `tlv:"1"`
+	}
+	if _, err := tlv.NewEncoder(io.Discard).EncodeObj(&bad{}); err == nil {
+		t.Fatalf("expect an error for duplicate field numbers")
+	}
+}
+
+// decimal 一个用私有 tag 编码的自定义类型，按十进制字符串编码
+type decimal struct {
+	unscaled int64
+	scale    int
+}
+
+const decimalTag = 100
+
+func init() {
+	err := tlv.RegisterPrivate(decimalTag, decimal{},
+		func(v interface{}) ([]byte, error) {
+			d := v.(decimal)
+			return []byte(strconv.FormatInt(d.unscaled, 10) + "e" + strconv.Itoa(d.scale)), nil
+		},
+		func(data []byte) (interface{}, error) {
+			i := bytes.IndexByte(data, 'e')
+			if i < 0 {
+				return nil, errors.New("bad decimal")
+			}
+			unscaled, err := strconv.ParseInt(string(data[:i]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			scale, err := strconv.Atoi(string(data[i+1:]))
+			if err != nil {
+				return nil, err
+			}
+			return decimal{unscaled: unscaled, scale: scale}, nil
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type tlvPrivate struct {
+	At      time.Time
+	Expire  *time.Time
+	Deleted *time.Time
+	Price   decimal
+	Prices  map[string]decimal
+}
+
+func TestTlvCodec_private(t *testing.T) {
+	now := time.Date(2021, 7, 1, 12, 30, 0, 123, time.FixedZone("CST", 8*3600))
+	expire := now.Add(time.Hour)
+	args := &tlvPrivate{
+		At:     now,
+		Expire: &expire,
+		Price:  decimal{unscaled: 1999, scale: 2},
+		Prices: map[string]decimal{"a": {1, 0}, "b": {-25, 1}},
+	}
+	var out tlvPrivate
+	roundTrip(t, TlvType, &Header{ServiceMethod: "Foo.Private"}, args, &out)
+	if !out.At.Equal(now) || out.Expire == nil || !out.Expire.Equal(expire) || out.Deleted != nil {
+		t.Fatalf("time mismatch: %+v", out)
+	}
+	if out.Price != args.Price || !reflect.DeepEqual(out.Prices, args.Prices) {
+		t.Fatalf("decimal mismatch: %+v", out)
+	}
+
+	t.Run("private frame into a plain type", func(t *testing.T) {
+		data, err := tlv.NewEncoder(io.Discard).EncodeObj(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s string
+		var te *tlv.TypeError
+		if err := tlv.NewDecoder(bytes.NewReader(data)).Decode(&s); !errors.As(err, &te) {
+			t.Fatalf("expect a TypeError, got %v", err)
+		}
+	})
+
+	t.Run("duplicate registration", func(t *testing.T) {
+		marshal := func(v interface{}) ([]byte, error) { return nil, nil }
+		unmarshal := func(data []byte) (interface{}, error) { return time.Duration(0), nil }
+		if err := tlv.RegisterPrivate(tlv.TimeTag, time.Duration(0), marshal, unmarshal); err == nil {
+			t.Fatalf("expect an error for a duplicate tag")
+		}
+		if err := tlv.RegisterPrivate(decimalTag+1, time.Time{}, marshal, unmarshal); err == nil {
+			t.Fatalf("expect an error for a duplicate type")
+		}
+	})
+}
+
+type tlvShape struct {
+	Name  string
+	Sides int
+}
+
+func init() {
+	if err := tlv.Register(tlvShape{}); err != nil {
+		panic(err)
+	}
+}
+
+type tlvAny struct {
+	Payload map[string]interface{}
+	Value   interface{}
+	Err     error
+	NilErr  error
+	List    []interface{}
+}
+
+func TestTlvCodec_interface(t *testing.T) {
+	at := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	args := &tlvAny{
+		Payload: map[string]interface{}{
+			"int":    -3,
+			"uint":   uint8(200),
+			"float":  1.5,
+			"string": "geerpc",
+			"bytes":  []byte{1, 2},
+			"nil":    nil,
+			"list":   []int{1, 2},
+			"nested": map[string]interface{}{"ok": true},
+			"shape":  tlvShape{Name: "triangle", Sides: 3},
+			"time":   at,
+		},
+		Value: tlvShape{Name: "square", Sides: 4},
+		Err:   errors.New("boom"),
+		List:  []interface{}{"a", int64(1), nil},
+	}
+	var out tlvAny
+	roundTrip(t, TlvType, &Header{ServiceMethod: "Foo.Any"}, args, &out)
+	want := map[string]interface{}{
+		"int":    int64(-3),
+		"uint":   uint64(200),
+		"float":  1.5,
+		"string": "geerpc",
+		"bytes":  []byte{1, 2},
+		"nil":    nil,
+		"list":   []interface{}{int64(1), int64(2)},
+		"nested": map[string]interface{}{"ok": true},
+		"shape":  tlvShape{Name: "triangle", Sides: 3},
+		"time":   at,
+	}
+	if !reflect.DeepEqual(out.Payload, want) {
+		t.Fatalf("payload mismatch:\n got %#v\nwant %#v", out.Payload, want)
+	}
+	if out.Value != args.Value || !reflect.DeepEqual(out.List, args.List) {
+		t.Fatalf("value mismatch: %+v", out)
+	}
+	if out.Err == nil || out.Err.Error() != "boom" || out.NilErr != nil {
+		t.Fatalf("error mismatch: %v, %v", out.Err, out.NilErr)
+	}
+
+	t.Run("unregistered struct", func(t *testing.T) {
+		type unregistered struct{ A int }
+		_, err := tlv.NewEncoder(io.Discard).EncodeObj(&tlvAny{Value: unregistered{}})
+		if err == nil {
+			t.Fatalf("expect an error for an unregistered type")
+		}
+	})
+
+	t.Run("not assignable", func(t *testing.T) {
+		data, err := tlv.NewEncoder(io.Discard).EncodeObj(&tlvAny{Value: "not an error"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Payload map[string]interface{}
+			Value   error
+		}
+		var te *tlv.TypeError
+		if err := tlv.NewDecoder(bytes.NewReader(data)).Decode(&out); !errors.As(err, &te) {
+			t.Fatalf("expect a TypeError, got %v", err)
+		}
+	})
+
+	t.Run("duplicate name", func(t *testing.T) {
+		if err := tlv.RegisterName("codec.tlvShape", tlvInner{}); err == nil {
+			t.Fatalf("expect an error for a duplicate name")
+		}
+		if err := tlv.Register(tlvShape{}); err == nil {
+			t.Fatalf("expect an error for a duplicate type")
+		}
+	})
+}
+
+type msgpackArgs struct {
+	Name    string            `msgpack:"name"`
+	Tags    []string          `msgpack:"tags,omitempty"`
+	Attrs   map[string]string `msgpack:"attrs"`
+	Secret  string            `msgpack:"-"`
+	Created int64
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Sum", Seq: 7, Error: "none"}
+	args := msgpackArgs{Name: "geerpc", Attrs: map[string]string{"k": "v"}, Secret: "s", Created: -1}
+	var out msgpackArgs
+	got := roundTrip(t, MsgpackType, h, &args, &out)
+	if !reflect.DeepEqual(got, h) {
+		t.Fatalf("header mismatch: got %+v, want %+v", got, h)
+	}
+	args.Secret = ""
+	if !reflect.DeepEqual(out, args) {
+		t.Fatalf("body mismatch:\n got %#v\nwant %#v", out, args)
+	}
+
+	t.Run("schema-less body", func(t *testing.T) {
+		// 非 Go 的客户端看到的是以标签名为 key 的 map
+		var m map[string]interface{}
+		roundTrip(t, MsgpackType, h, &args, &m)
+		if m["name"] != "geerpc" || m["Created"] != int64(-1) {
+			t.Fatalf("unexpected map: %#v", m)
+		}
+		if _, ok := m["tags"]; ok {
+			t.Fatalf("omitempty field should be omitted: %#v", m)
+		}
+	})
+
+	t.Run("discard body", func(t *testing.T) {
+		roundTrip(t, MsgpackType, h, &args, nil)
+	})
+}
+
+func TestProtoCodec(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Echo", Seq: 1 << 40, Error: "none"}
+	args, err := structpb.NewStruct(map[string]interface{}{"name": "geerpc", "tags": []interface{}{"a", 1.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &structpb.Struct{}
+	got := roundTrip(t, ProtoType, h, args, out)
+	if !reflect.DeepEqual(got, h) {
+		t.Fatalf("header mismatch: got %+v, want %+v", got, h)
+	}
+	if !proto.Equal(out, args) {
+		t.Fatalf("body mismatch: got %v, want %v", out, args)
+	}
+}
+
+func TestProtoCodec_notProtoMessage(t *testing.T) {
+	conn := &bufferConn{}
+	c := NewProtoCodec(conn)
+	if err := c.Write(&Header{ServiceMethod: "Foo.Sum"}, &testArgs{Num1: 1}); !errors.Is(err, ErrNotProtoMessage) {
+		t.Fatalf("expect ErrNotProtoMessage, got %v", err)
+	}
+	if conn.Len() != 0 {
+		t.Fatalf("nothing should be written for a rejected body")
+	}
+	// 服务端回写错误时的占位 body 写成空帧
+	if err := c.Write(&Header{Seq: 1, Error: "boom"}, struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(&Header{Seq: 2}, wrapperspb.String("ok")); err != nil {
+		t.Fatal(err)
+	}
+	var h Header
+	if err := c.ReadHeader(&h); err != nil || h.Error != "boom" {
+		t.Fatalf("read header: %+v, %v", h, err)
+	}
+	var reply int
+	if err := c.ReadBody(&reply); !errors.Is(err, ErrNotProtoMessage) {
+		t.Fatalf("expect ErrNotProtoMessage, got %v", err)
+	}
+	// 类型不对的 body 也已经被读出来了，下一对 Header 和 Body 可以正常读
+	out := &wrapperspb.StringValue{}
+	if err := c.ReadHeader(&h); err != nil || h.Seq != 2 {
+		t.Fatalf("read header: %+v, %v", h, err)
+	}
+	if err := c.ReadBody(out); err != nil || out.GetValue() != "ok" {
+		t.Fatalf("read body: %v, %v", out, err)
+	}
+}
+
+// TestTlvCodec_quick 随机生成 Header 和 Body，经过 TlvCodec 写入再读出来，结果应该完全一样
+func TestTlvCodec_quick(t *testing.T) {
+	f := func(h Header, args tlvArgs) bool {
+		conn := &bufferConn{}
+		c := NewTlvCodec(conn)
+		if err := c.Write(&h, &args); err != nil {
+			t.Logf("write: %v", err)
+			return false
+		}
+		var gotH Header
+		var got tlvArgs
+		if err := c.ReadHeader(&gotH); err != nil {
+			t.Logf("read header: %v", err)
+			return false
+		}
+		if err := c.ReadBody(&got); err != nil {
+			t.Logf("read body: %v", err)
+			return false
+		}
+		return reflect.DeepEqual(gotH, h) && reflect.DeepEqual(got, args) && conn.Len() == 0
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 200}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// FuzzTlvCodec 把任意字节当成连接上读到的数据交给 TlvCodec，服务端的读循环不能因此 panic
+func FuzzTlvCodec(f *testing.F) {
+	seed := &bufferConn{}
+	c := NewTlvCodec(seed)
+	_ = c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &tlvArgs{Names: []string{"a"}, Inner: &tlvInner{Arg3: 1}})
+	_ = c.Write(&Header{ServiceMethod: "Foo.Any", Seq: 2}, &tlvAny{Payload: map[string]interface{}{"k": 1}})
+	f.Add(seed.Bytes())
+	f.Add([]byte{0x39, 0x03, 0x01, 0x18, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := &bufferConn{}
+		conn.Write(data)
+		c := NewTlvCodec(conn)
+		for {
+			var h Header
+			if err := c.ReadHeader(&h); err != nil {
+				return
+			}
+			var body interface{}
+			if err := c.ReadBody(&body); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestCompressCodec(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Echo", Seq: 3}
+	large := strings.Repeat("geerpc ", 1024)
+	for _, c := range []Compression{CompressGzip, CompressSnappy, CompressZstd} {
+		t.Run(string(c), func(t *testing.T) {
+			conn := &bufferConn{}
+			cc, err := NewCompressCodec(NewGobCodec, conn, c, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, body := range []string{large, "small"} {
+				if err = cc.Write(h, body); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				// 超过阈值的消息压缩，没超过的原样发送
+				compressed := conn.Bytes()[0] != 0
+				if compressed != (len(body) >= DefaultCompressThreshold) {
+					t.Fatalf("body of %d bytes: compressed = %t", len(body), compressed)
+				}
+				if body == large && conn.Len() >= len(large) {
+					t.Fatalf("frame of %d bytes is not smaller than the body", conn.Len())
+				}
+				got, out := &Header{}, ""
+				if err = cc.ReadHeader(got); err != nil {
+					t.Fatalf("read header: %v", err)
+				}
+				if err = cc.ReadBody(&out); err != nil {
+					t.Fatalf("read body: %v", err)
+				}
+				if !reflect.DeepEqual(got, h) || out != body {
+					t.Fatalf("round trip mismatch: %+v %.20q", got, out)
+				}
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		if _, err := NewCompressCodec(NewGobCodec, &bufferConn{}, "lz4", 0); err == nil {
+			t.Fatal("expect an error for unsupported compression")
+		}
+		if ValidCompression("lz4") || !ValidCompression(CompressNone) {
+			t.Fatal("unexpected ValidCompression result")
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		for _, data := range [][]byte{
+			{9, 1, 0},                         // 不认识的压缩算法
+			{1, 3, 1, 2, 3},                   // 不是合法的 gzip 数据
+			{0, 5, 1},                         // 帧不完整
+			{2, 0xff, 0xff, 0xff, 0xff, 0x7f}, // 帧太大
+		} {
+			conn := &bufferConn{}
+			conn.Write(data)
+			cc, _ := NewCompressCodec(NewGobCodec, conn, CompressGzip, 0)
+			if err := cc.ReadHeader(&Header{}); err == nil {
+				t.Fatalf("expect an error for % x", data)
+			}
+		}
+	})
+}
+
+func TestFrameCodec(t *testing.T) {
+	h := &Header{ServiceMethod: "Foo.Echo", Seq: 3}
+	for _, typ := range []Type{GobType, JsonType, TlvType, MsgpackType, ProtoType} {
+		t.Run(string(typ), func(t *testing.T) {
+			newCodec, _ := Lookup(typ)
+			conn := &bufferConn{}
+			cc := NewFrameCodec(newCodec, conn, 0)
+			var body, out interface{} = &testArgs{Num1: 1, Name: "geerpc"}, &testArgs{}
+			if typ == ProtoType {
+				body, out = wrapperspb.String("geerpc"), &wrapperspb.StringValue{}
+			}
+			// 第一个 Body 跳过，第二个正常读出来
+			for i := 0; i < 2; i++ {
+				if err := cc.Write(h, body); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			got := &Header{}
+			if err := cc.ReadHeader(got); err != nil || !reflect.DeepEqual(got, h) {
+				t.Fatalf("read header: %+v, %v", got, err)
+			}
+			if err := cc.ReadBody(nil); err != nil {
+				t.Fatalf("discard body: %v", err)
+			}
+			if err := cc.ReadHeader(got); err != nil || !reflect.DeepEqual(got, h) {
+				t.Fatalf("read header: %+v, %v", got, err)
+			}
+			if err := cc.ReadBody(out); err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+			if typ == ProtoType && !proto.Equal(out.(proto.Message), body.(proto.Message)) ||
+				typ != ProtoType && !reflect.DeepEqual(out, body) {
+				t.Fatalf("body mismatch: got %v, want %v", out, body)
+			}
+			if conn.Len() != 0 {
+				t.Fatalf("%d bytes left", conn.Len())
+			}
+		})
+	}
+
+	t.Run("skip without decoding", func(t *testing.T) {
+		// Body 是乱码也能跳过，说明没有解码
+		conn := &bufferConn{}
+		cc := NewFrameCodec(NewJsonCodec, conn, 0)
+		_ = cc.Write(h, "ok")
+		data := conn.Bytes()
+		headerLen := int(data[0])
+		conn.Reset()
+		conn.Write([]byte{byte(headerLen), 3})
+		conn.Write(data[2 : 2+headerLen])
+		conn.Write([]byte("{{{"))
+		_ = cc.Write(h, "ok")
+		var s string
+		if err := cc.ReadHeader(&Header{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.ReadBody(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.ReadHeader(&Header{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.ReadBody(&s); err != nil || s != "ok" {
+			t.Fatalf("read body: %q, %v", s, err)
+		}
+	})
+
+	t.Run("max message size", func(t *testing.T) {
+		conn := &bufferConn{}
+		cc := NewFrameCodec(NewTlvCodec, conn, 64)
+		if err := cc.Write(h, strings.Repeat("x", 64)); !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("expect ErrMessageTooLarge, got %v", err)
+		}
+		if conn.Len() != 0 {
+			t.Fatal("nothing should be written")
+		}
+		// 写失败之后连接还可以继续用
+		if err := cc.Write(h, "small"); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := NewFrameCodec(NewTlvCodec, conn, 16).ReadHeader(&Header{}); !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("expect ErrMessageTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		// 实现了 Framer 的 Codec 出错之后连接还可以继续用，gob 出错之后状态已经对不上了，连接会被关闭
+		for _, c := range []struct {
+			newCodec NewCodecFunc
+			closed   bool
+		}{{NewTlvCodec, false}, {NewGobCodec, true}} {
+			conn := &closeConn{}
+			cc := NewFrameCodec(c.newCodec, conn, 0)
+			if err := cc.Write(h, make(chan int)); err == nil {
+				t.Fatal("expect an error for an unsupported body")
+			}
+			if conn.Len() != 0 || conn.closed != c.closed {
+				t.Fatalf("%d bytes written, closed: %v, want %v", conn.Len(), conn.closed, c.closed)
+			}
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		conn := &bufferConn{}
+		cc := NewFrameCodec(NewTlvCodec, conn, 0)
+		if err := cc.ReadHeader(&Header{}); err != io.EOF {
+			t.Fatalf("expect io.EOF at the boundary, got %v", err)
+		}
+		conn.Write([]byte{10, 0, 1, 2})
+		if err := cc.ReadHeader(&Header{}); err == nil {
+			t.Fatal("expect an error for a truncated message")
+		}
+	})
+}
+
+// bufferConn 把 bytes.Buffer 当成连接用，写进去的数据可以原样读出来
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error { return nil }
+
+// closeConn 记下有没有被关闭的 bufferConn
+type closeConn struct {
+	bufferConn
+	closed bool
+}
+
+func (c *closeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+type benchArgs struct {
+	ID     int64
+	Name   string
+	Tags   []string
+	Scores map[string]int64
+	Inner  *tlvInner
+	Amount float64
+}
+
+var benchBody = benchArgs{
+	ID:     1 << 40,
+	Name:   "geerpc benchmark",
+	Tags:   []string{"a", "b", "c", "d"},
+	Scores: map[string]int64{"x": 1, "y": 2, "z": 3},
+	Inner:  &tlvInner{Arg3: 7, Tags: []string{"inner"}},
+	Amount: 3.1415926,
+}
+
+// benchmarkCodec 每次迭代写入一对 Header + Body，再把它们读出来
+func benchmarkCodec(b *testing.B, typ Type) {
+	conn := &bufferConn{}
+	newCodec, _ := Lookup(typ)
+	cc := newCodec(conn)
+	h := &Header{ServiceMethod: "Foo.Sum"}
+	var gotH Header
+	var gotBody benchArgs
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Seq = uint64(i)
+		if err := cc.Write(h, &benchBody); err != nil {
+			b.Fatal(err)
+		}
+		if err := cc.ReadHeader(&gotH); err != nil {
+			b.Fatal(err)
+		}
+		gotBody = benchArgs{}
+		if err := cc.ReadBody(&gotBody); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGobCodec(b *testing.B) { benchmarkCodec(b, GobType) }
+func BenchmarkTlvCodec(b *testing.B) { benchmarkCodec(b, TlvType) }
+
+// BenchmarkTlvEncode 只测编码，编码缓冲区来自 sync.Pool，结构体部分不应该有额外的内存分配
+func BenchmarkTlvEncode(b *testing.B) {
+	enc := tlv.NewEncoder(io.Discard)
+	body := struct {
+		ID   int64
+		Name string
+		Tags []string
+		Flag bool
+	}{ID: 42, Name: "geerpc", Tags: []string{"a", "b"}, Flag: true}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(&body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
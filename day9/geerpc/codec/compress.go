@@ -0,0 +1,306 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩层：客户端在 Option 中选择压缩方式和压缩阈值，握手之后双方都在原来的 Codec 外面再包一层 CompressCodec。
+// 原来的 Codec 不再直接读写连接，而是读写一个 compressConn：
+//   - 写：Codec 每次 Write 的 Header + Body 先写到缓冲区里，超过阈值的话整体压缩，再作为一帧写到连接上
+//   - 读：每一帧解压之后交给 Codec 去读，Codec 感觉不到压缩的存在
+// 每一帧的格式为：| 压缩算法（1 字节） | 长度（varint） | 数据 |
+// 因为每一帧都标明了自己的压缩算法，所以没有超过阈值的消息可以不压缩，对端也不需要知道阈值是多少
+
+// Compression 压缩方式
+type Compression string
+
+const (
+	CompressNone   Compression = ""       // 不压缩
+	CompressGzip   Compression = "gzip"   // 标准库的 gzip，压缩率较高，速度一般
+	CompressSnappy Compression = "snappy" // Snappy 块格式，压缩率一般，但是非常快
+	CompressZstd   Compression = "zstd"   // 纯 Go 实现的 zstd，兼顾压缩率和速度
+)
+
+// DefaultCompressThreshold 默认的压缩阈值，太小的消息压缩之后反而可能变大，不值得
+const DefaultCompressThreshold = 1024
+
+// maxCompressFrameSize 一帧解压前后最大的字节数，防止对端用一个很小的压缩包让我们分配巨大的内存
+const maxCompressFrameSize = 64 * 1024 * 1024
+
+// compressor 一种压缩算法。id 写在每一帧的开头
+type compressor struct {
+	id         byte
+	compress   func(dst, src []byte) ([]byte, error)
+	decompress func(src []byte) ([]byte, error)
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// initZstd zstd 的编解码器比较重，第一次用到的时候再创建。EncodeAll 和 DecodeAll 都是并发安全的，全局共用一个即可
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEnc, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxCompressFrameSize))
+	})
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+var compressors = map[Compression]*compressor{
+	CompressGzip: {
+		id: 1,
+		compress: func(dst, src []byte) ([]byte, error) {
+			buf := bytes.NewBuffer(dst)
+			w := gzipWriters.Get().(*gzip.Writer)
+			defer gzipWriters.Put(w)
+			w.Reset(buf)
+			if _, err := w.Write(src); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decompress: func(src []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(io.LimitReader(r, maxCompressFrameSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > maxCompressFrameSize {
+				return nil, fmt.Errorf("rpc codec: 解压后的大小超过了 %d", maxCompressFrameSize)
+			}
+			return data, nil
+		},
+	},
+	CompressSnappy: {
+		id: 2,
+		compress: func(dst, src []byte) ([]byte, error) {
+			return s2.EncodeSnappy(dst[:cap(dst)], src), nil
+		},
+		decompress: func(src []byte) ([]byte, error) {
+			n, err := s2.DecodedLen(src)
+			if err != nil {
+				return nil, err
+			}
+			if n > maxCompressFrameSize {
+				return nil, fmt.Errorf("rpc codec: 解压后的大小超过了 %d", maxCompressFrameSize)
+			}
+			return s2.Decode(nil, src)
+		},
+	},
+	CompressZstd: {
+		id: 3,
+		compress: func(dst, src []byte) ([]byte, error) {
+			initZstd()
+			return zstdEnc.EncodeAll(src, dst), nil
+		},
+		decompress: func(src []byte) ([]byte, error) {
+			initZstd()
+			return zstdDec.DecodeAll(src, nil)
+		},
+	},
+}
+
+// compressorByID 读的时候根据帧开头的 id 找压缩算法，0 表示没有压缩
+func compressorByID(id byte) *compressor {
+	for _, c := range compressors {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// CompressionID 压缩方式的编号，握手时用一个字节表示压缩方式，0 表示不压缩
+func CompressionID(c Compression) (byte, bool) {
+	if c == CompressNone {
+		return 0, true
+	}
+	comp, ok := compressors[c]
+	if !ok {
+		return 0, false
+	}
+	return comp.id, true
+}
+
+// CompressionByID CompressionID 的逆运算
+func CompressionByID(id byte) (Compression, bool) {
+	if id == 0 {
+		return CompressNone, true
+	}
+	for c, comp := range compressors {
+		if comp.id == id {
+			return c, true
+		}
+	}
+	return CompressNone, false
+}
+
+// ValidCompression 判断是否支持这种压缩方式
+func ValidCompression(c Compression) bool {
+	if c == CompressNone {
+		return true
+	}
+	_, ok := compressors[c]
+	return ok
+}
+
+// CompressCodec 在任意一个 Codec 的外面加上压缩
+type CompressCodec struct {
+	Codec
+	conn *compressConn
+}
+
+// NewCompressCodec 用 newCodec 创建内层的 Codec，序列化之后不小于 threshold 字节的消息用 c 压缩，threshold <= 0 时使用默认阈值
+func NewCompressCodec(newCodec NewCodecFunc, conn io.ReadWriteCloser, c Compression, threshold int) (Codec, error) {
+	comp, ok := compressors[c]
+	if !ok {
+		return nil, fmt.Errorf("rpc codec: unsupported compression %q", c)
+	}
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	cc := &compressConn{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		w:         bufio.NewWriter(conn),
+		comp:      comp,
+		threshold: threshold,
+	}
+	return &CompressCodec{Codec: newCodec(cc), conn: cc}, nil
+}
+
+func (c *CompressCodec) Write(header *Header, body interface{}) error {
+	// 内层的 Codec 写到缓冲区里，写完一整对 Header 和 Body 之后再作为一帧发出去。
+	// 调用方写的时候是加了锁的，所以缓冲区里不会混进别的消息
+	if err := c.Codec.Write(header, body); err != nil {
+		c.conn.pending.Reset()
+		return err
+	}
+	if err := c.conn.flush(); err != nil {
+		_ = c.Close()
+		return err
+	}
+	return nil
+}
+
+// compressConn 内层 Codec 看到的"连接"
+type compressConn struct {
+	conn      io.ReadWriteCloser
+	r         *bufio.Reader
+	w         *bufio.Writer
+	comp      *compressor
+	threshold int
+
+	pending bytes.Buffer // 还没有发出去的数据
+	scratch []byte       // 压缩用的缓冲区
+	frame   []byte       // 当前这一帧解压后的数据
+	offset  int          // frame 读到的位置
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	return c.pending.Write(p)
+}
+
+// flush 把缓冲区中的数据作为一帧写到连接上
+func (c *compressConn) flush() error {
+	data := c.pending.Bytes()
+	defer c.pending.Reset()
+	id := byte(0)
+	if len(data) >= c.threshold {
+		compressed, err := c.comp.compress(c.scratch[:0], data)
+		if err != nil {
+			return err
+		}
+		c.scratch = compressed
+		if len(compressed) < len(data) { // 压缩之后没有变小的话，还是发原始数据
+			id, data = c.comp.id, compressed
+		}
+	}
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(data)))
+	if err := c.w.WriteByte(id); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(size[:n]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	for c.offset == len(c.frame) {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.frame[c.offset:])
+	c.offset += n
+	return n, nil
+}
+
+func (c *compressConn) readFrame() error {
+	id, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if size > maxCompressFrameSize {
+		return fmt.Errorf("rpc codec: 压缩帧大小 %d 超过了 %d", size, maxCompressFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(c.r, data); err != nil {
+		return unexpectedEOF(err)
+	}
+	if id != 0 {
+		comp := compressorByID(id)
+		if comp == nil {
+			return fmt.Errorf("rpc codec: unknown compression id %d", id)
+		}
+		if data, err = comp.decompress(data); err != nil {
+			return err
+		}
+	}
+	c.frame, c.offset = data, 0
+	return nil
+}
+
+// unexpectedEOF 帧读到一半遇到 EOF，说明数据不完整
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *compressConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,205 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 分帧层：原来每个 Codec 都要靠自己的解码器在连接上找消息的边界（gob.Decoder、一个字节一个字节读的 tlv Decoder），
+// 不把一个 Body 完整地解码出来，就不知道下一个 Header 从哪里开始。FrameCodec 在每一对 Header 和 Body 前面加上它们的长度：
+// | Header 长度（varint） | Body 长度（varint） | Header | Body |
+// 这样不需要解码就可以跳过一个 Body（服务端找不到方法、客户端丢弃已经移除的 call 时都会调用 ReadBody(nil)），
+// 也可以在读之前就拒绝过大的消息。
+// 内层的 Codec 实现了 Framer 时，Header 和 Body 分开记录长度，ReadBody(nil) 直接丢掉 Body 的字节；
+// 否则（比如 gob，Body 中可能带着之后的消息要用到的类型信息，不能跳过）整个消息都算作 Header，ReadBody 仍然交给内层的 Codec
+
+// DefaultMaxMessageSize 默认的消息（Header + Body）最大字节数
+const DefaultMaxMessageSize = 64 * 1024 * 1024
+
+// ErrMessageTooLarge 消息超过了最大字节数
+var ErrMessageTooLarge = errors.New("rpc codec: message too large")
+
+// Framer 可以把 Header 和 Body 分开写的 Codec。
+// WriteHeader 和 WriteBody 各自把编码好的数据写到连接上，出错时丢弃写了一半的数据，但不关闭连接。
+// 实现 Framer 的 Codec 的每个 Body 都是独立的，跳过一个 Body 不影响之后的解码
+type Framer interface {
+	Codec
+	WriteHeader(header *Header) error
+	WriteBody(body interface{}) error
+}
+
+// FrameCodec 在任意一个 Codec 的外面加上长度前缀
+type FrameCodec struct {
+	Codec
+	framer Framer // 内层的 Codec 实现了 Framer 时不为空
+	conn   *frameConn
+}
+
+// NewFrameCodec 用 newCodec 创建内层的 Codec，读写的消息都不能超过 maxSize 字节，maxSize <= 0 时使用默认值
+func NewFrameCodec(newCodec NewCodecFunc, conn io.ReadWriteCloser, maxSize int) Codec {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	fc := &frameConn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		maxSize: maxSize,
+	}
+	c := &FrameCodec{Codec: newCodec(fc), conn: fc}
+	c.framer, _ = c.Codec.(Framer)
+	return c
+}
+
+func (c *FrameCodec) ReadHeader(header *Header) error {
+	// 上一个消息没有读完的部分直接丢掉，不管内层的 Codec 读成了什么样，下一个消息总能从正确的位置开始
+	if err := c.conn.next(); err != nil {
+		return err
+	}
+	return c.Codec.ReadHeader(header)
+}
+
+func (c *FrameCodec) ReadBody(body interface{}) error {
+	if c.framer == nil {
+		return c.Codec.ReadBody(body)
+	}
+	if body == nil { // 不需要解码，直接跳过
+		return c.conn.skip()
+	}
+	c.conn.startBody()
+	return c.Codec.ReadBody(body)
+}
+
+func (c *FrameCodec) Write(header *Header, body interface{}) error {
+	// 内层的 Codec 写到缓冲区里，最后连同长度一起发出去。
+	// 内层的 Codec 实现了 Framer 时，每个消息都是独立的，还没发出去之前出错的话，连接上什么也没写，丢掉缓冲区就行，连接还可以继续用。
+	// 没有实现 Framer 的 Codec 就不一定了：gob 的编码器会记下已经发过的类型信息，丢掉缓冲区之后它和对端就对不上了，
+	// 而且 gob 出错时本来就会关闭它的连接（也就是 frameConn，最终关闭真正的连接），所以这时和不分帧一样关闭连接
+	if c.framer == nil {
+		err := c.Codec.Write(header, body)
+		if err == nil {
+			err = c.conn.flush(c.conn.pending.Len())
+		}
+		if err != nil {
+			c.conn.pending.Reset()
+			_ = c.conn.Close()
+		}
+		return err
+	}
+	if err := c.framer.WriteHeader(header); err != nil {
+		c.conn.pending.Reset()
+		return err
+	}
+	headerLen := c.conn.pending.Len()
+	if err := c.framer.WriteBody(body); err != nil {
+		c.conn.pending.Reset()
+		return err
+	}
+	return c.conn.flush(headerLen)
+}
+
+// frameConn 内层 Codec 看到的"连接"，读的时候只能读到当前消息的 Header 或者 Body，读完了返回 io.EOF
+type frameConn struct {
+	conn    io.ReadWriteCloser
+	r       *bufio.Reader
+	w       *bufio.Writer
+	maxSize int
+
+	pending bytes.Buffer // 还没有发出去的消息
+
+	header, body int  // 当前消息还没有读的 Header、Body 字节数
+	inBody       bool // 是否已经开始读 Body 了
+}
+
+func (c *frameConn) Write(p []byte) (int, error) {
+	return c.pending.Write(p)
+}
+
+// flush 把缓冲区中的消息写到连接上，前 headerLen 个字节是 Header
+func (c *frameConn) flush(headerLen int) error {
+	defer c.pending.Reset()
+	data := c.pending.Bytes()
+	if len(data) > c.maxSize {
+		return fmt.Errorf("%w：%d 字节，最多 %d 字节", ErrMessageTooLarge, len(data), c.maxSize)
+	}
+	var lengths [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lengths[:], uint64(headerLen))
+	n += binary.PutUvarint(lengths[n:], uint64(len(data)-headerLen))
+	_, err := c.w.Write(lengths[:n])
+	if err == nil {
+		_, err = c.w.Write(data)
+	}
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil { // 写了一半，连接上的数据已经不完整了，只能关闭连接
+		_ = c.conn.Close()
+	}
+	return err
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	remain := &c.header
+	if c.inBody {
+		remain = &c.body
+	}
+	if *remain == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > *remain {
+		p = p[:*remain]
+	}
+	n, err := c.r.Read(p)
+	*remain -= n
+	return n, unexpectedEOF(err)
+}
+
+// next 丢掉当前消息没有读完的部分，再读出下一个消息的长度
+func (c *frameConn) next() error {
+	if err := c.skip(); err != nil {
+		return err
+	}
+	header, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err // 在消息的边界遇到 EOF，说明对端正常关闭了连接
+	}
+	body, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if header > uint64(c.maxSize) || body > uint64(c.maxSize)-header {
+		return fmt.Errorf("%w：%d 字节，最多 %d 字节", ErrMessageTooLarge, header+body, c.maxSize)
+	}
+	c.header, c.body, c.inBody = int(header), int(body), false
+	return nil
+}
+
+// startBody 开始读 Body。Header 正常情况下已经读完了，剩下的部分丢掉
+func (c *frameConn) startBody() {
+	if c.header > 0 {
+		n, _ := c.r.Discard(c.header)
+		c.header -= n
+	}
+	c.inBody = true
+}
+
+// skip 丢掉当前消息剩下的部分
+func (c *frameConn) skip() error {
+	n, err := c.r.Discard(c.header + c.body)
+	if n >= c.header {
+		c.header, c.body = 0, c.body-(n-c.header)
+	} else {
+		c.header -= n
+	}
+	c.inBody = true
+	return unexpectedEOF(err)
+}
+
+// Close 关闭真正的连接。内层的 Codec 写出错时也会调用它，见 FrameCodec.Write
+func (c *frameConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+// JsonCodec 与 GobCodec 的结构一模一样，只是把编解码器换成了 encoding/json 里面的
+// 这样 Python 脚本、jq 之类的非 Go 工具也能直接和 geerpc 服务端通信
+type JsonCodec struct {
+	enc  *json.Encoder      // 编码器
+	dec  *json.Decoder      // 解码器，json.Decoder 本身就是流式解码的，一次只取一个 json 值
+	conn io.ReadWriteCloser // 连接
+	buf  *bufio.Writer      // 带缓冲的 Writer，给 enc 使用
+}
+
+func (j *JsonCodec) Close() error {
+	return j.conn.Close()
+}
+
+func (j *JsonCodec) ReadHeader(header *Header) error {
+	return j.dec.Decode(header)
+}
+
+func (j *JsonCodec) ReadBody(body interface{}) error {
+	// 与 gob 不同，json 不能解码到 nil 里面。客户端丢弃 Body 时会传 nil，这里用 RawMessage 把这个值读出来丢掉
+	if body == nil {
+		var discard json.RawMessage
+		return j.dec.Decode(&discard)
+	}
+	return j.dec.Decode(body)
+}
+
+func (j *JsonCodec) Write(header *Header, body interface{}) (err error) {
+	defer func() {
+		_ = j.buf.Flush()
+		if err != nil { // 写入的过程发生错误，关闭连接
+			_ = j.conn.Close()
+		}
+	}()
+	if err := j.enc.Encode(header); err != nil {
+		log.Println("JsonCodec: 写入 header 失败：", err)
+		return err
+	}
+	if err := j.enc.Encode(body); err != nil {
+		log.Println("JsonCodec: 写入 body 失败：", err)
+		return err
+	}
+	return nil
+}
+
+// WriteHeader 与 Write 不同，只写 Header，写完立即 flush，出错时也不关闭连接，给 FrameCodec 使用
+func (j *JsonCodec) WriteHeader(header *Header) error {
+	return j.encode(header)
+}
+
+// WriteBody 只写 Body，同上
+func (j *JsonCodec) WriteBody(body interface{}) error {
+	return j.encode(body)
+}
+
+// encode 编码一个值并 flush，出错时丢掉缓冲区里写了一半的数据
+func (j *JsonCodec) encode(v interface{}) error {
+	if err := j.enc.Encode(v); err != nil {
+		j.buf.Reset(j.conn)
+		return err
+	}
+	return j.buf.Flush()
+}
+
+// NewJsonCodec JsonCodec 的构造函数
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &JsonCodec{
+		conn: conn,
+		buf:  buf,
+		enc:  json.NewEncoder(buf),
+		dec:  json.NewDecoder(conn),
+	}
+}
+
+var _ Framer = &JsonCodec{}
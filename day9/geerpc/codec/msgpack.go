@@ -0,0 +1,87 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec 使用 MessagePack 编码。与 JSON 一样不需要事先定义 schema，但是更紧凑，而且几乎每种语言都有现成的实现，
+// 非 Go 的客户端只需要依次写入两个 MessagePack 对象即可：
+// | Header{"ServiceMethod": ..., "Seq": ..., "Error": ...} | Body |
+// 结构体默认编码成以字段名为 key 的 map，可以用 `msgpack:"name"` 标签改名，`msgpack:"-"` 忽略字段
+type MsgpackCodec struct {
+	enc  *msgpack.Encoder   // 编码器
+	dec  *msgpack.Decoder   // 解码器，同样是流式解码的，一次只取一个对象
+	conn io.ReadWriteCloser // 连接
+	buf  *bufio.Writer      // 带缓冲的 Writer，给 enc 使用
+}
+
+func (m *MsgpackCodec) Close() error {
+	return m.conn.Close()
+}
+
+func (m *MsgpackCodec) ReadHeader(header *Header) error {
+	return m.dec.Decode(header)
+}
+
+func (m *MsgpackCodec) ReadBody(body interface{}) error {
+	// 客户端丢弃 Body 时会传 nil，直接跳过这个对象
+	if body == nil {
+		return m.dec.Skip()
+	}
+	return m.dec.Decode(body)
+}
+
+func (m *MsgpackCodec) Write(header *Header, body interface{}) (err error) {
+	defer func() {
+		_ = m.buf.Flush()
+		if err != nil { // 写入的过程发生错误，关闭连接
+			_ = m.conn.Close()
+		}
+	}()
+	if err := m.enc.Encode(header); err != nil {
+		log.Println("MsgpackCodec: 写入 header 失败：", err)
+		return err
+	}
+	if err := m.enc.Encode(body); err != nil {
+		log.Println("MsgpackCodec: 写入 body 失败：", err)
+		return err
+	}
+	return nil
+}
+
+// WriteHeader 与 Write 不同，只写 Header，写完立即 flush，出错时也不关闭连接，给 FrameCodec 使用
+func (m *MsgpackCodec) WriteHeader(header *Header) error {
+	return m.encode(header)
+}
+
+// WriteBody 只写 Body，同上
+func (m *MsgpackCodec) WriteBody(body interface{}) error {
+	return m.encode(body)
+}
+
+// encode 编码一个值并 flush，出错时丢掉缓冲区里写了一半的数据
+func (m *MsgpackCodec) encode(v interface{}) error {
+	if err := m.enc.Encode(v); err != nil {
+		m.buf.Reset(m.conn)
+		return err
+	}
+	return m.buf.Flush()
+}
+
+// NewMsgpackCodec MsgpackCodec 的构造函数
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  buf,
+		enc:  msgpack.NewEncoder(buf),
+		// 解码器读的时候需要 io.ByteScanner，直接传 conn 的话它自己会套一层 bufio.Reader
+		dec: msgpack.NewDecoder(conn),
+	}
+}
+
+var _ Framer = &MsgpackCodec{}
@@ -0,0 +1,312 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtoCodec 使用 Protocol Buffers 编码，方便复用其他团队在 .proto 文件中定义好的消息。
+// Header 和 Body 各占一帧，每一帧的开头是变长编码（varint）的长度，后面是 protobuf 编码的消息：
+// | len | Header | len | Body | len | Header | len | Body | ...
+// Header 按照下面的 .proto 定义手动编码，不需要生成代码：
+//
+//	message Header {
+//	  string service_method = 1;
+//	  uint64 seq = 2;
+//	  string error = 3;
+//	  map<string, string> metadata = 4;
+//	  int64 timeout = 5; // 纳秒
+//	  bool cancel = 6;
+//	  bool go_away = 7;
+//	}
+//
+// Body 必须实现 proto.Message，也就是说服务方法的参数和返回值都得是 protoc 生成的消息类型（的指针）
+type ProtoCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer // 与 GobCodec 一样，写的时候用带缓冲的 Writer
+	r    *bufio.Reader // 读长度的时候是一个字节一个字节读的，同样套一层缓冲
+	// frame 读帧用的缓冲区，Header 和 Body 是按顺序读的，可以复用
+	frame []byte
+}
+
+// maxProtoFrameSize 一帧最大的字节数，超过的话说明数据有问题，直接返回错误，免得按一个错误的长度分配巨大的内存
+const maxProtoFrameSize = 64 * 1024 * 1024
+
+// ErrNotProtoMessage Body 没有实现 proto.Message
+var ErrNotProtoMessage = errors.New("rpc codec: protobuf 编码的 body 必须实现 proto.Message")
+
+func (p *ProtoCodec) Close() error {
+	return p.conn.Close()
+}
+
+func (p *ProtoCodec) ReadHeader(header *Header) error {
+	frame, err := p.readFrame()
+	if err != nil {
+		return err
+	}
+	return unmarshalHeader(frame, header)
+}
+
+func (p *ProtoCodec) ReadBody(body interface{}) error {
+	// 不管 body 是什么类型，都先把这一帧读出来，这样即使类型不对，流也不会错位
+	frame, err := p.readFrame()
+	if err != nil || body == nil { // body 为 nil 时直接丢弃
+		return err
+	}
+	msg, ok := body.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w，实际是 %T", ErrNotProtoMessage, body)
+	}
+	return proto.Unmarshal(frame, msg)
+}
+
+func (p *ProtoCodec) Write(header *Header, body interface{}) (err error) {
+	// 先检查 body 的类型，这时还什么都没写，所以不用关闭连接，调用方换一个参数就可以继续用
+	msg, ok := body.(proto.Message)
+	if !ok && !isEmptyBody(body) {
+		return fmt.Errorf("%w，实际是 %T", ErrNotProtoMessage, body)
+	}
+	defer func() {
+		_ = p.buf.Flush()
+		if err != nil { // 与 GobCodec 一样，写入出错的话关闭连接
+			_ = p.conn.Close()
+		}
+	}()
+	if err = p.writeFrame(marshalHeader(header)); err != nil {
+		log.Println("ProtoCodec: 写入 header 失败：", err)
+		return err
+	}
+	var data []byte
+	if ok {
+		if data, err = proto.Marshal(msg); err != nil {
+			log.Println("ProtoCodec: 编码 body 失败：", err)
+			return err
+		}
+	}
+	if err = p.writeFrame(data); err != nil {
+		log.Println("ProtoCodec: 写入 body 失败：", err)
+		return err
+	}
+	return nil
+}
+
+// WriteHeader 与 Write 不同，只写 Header，写完立即 flush，出错时也不关闭连接，给 FrameCodec 使用
+func (p *ProtoCodec) WriteHeader(header *Header) error {
+	return p.flushFrame(marshalHeader(header))
+}
+
+// WriteBody 只写 Body，同上
+func (p *ProtoCodec) WriteBody(body interface{}) error {
+	var data []byte
+	if msg, ok := body.(proto.Message); ok {
+		var err error
+		if data, err = proto.Marshal(msg); err != nil {
+			return err
+		}
+	} else if !isEmptyBody(body) {
+		return fmt.Errorf("%w，实际是 %T", ErrNotProtoMessage, body)
+	}
+	return p.flushFrame(data)
+}
+
+// flushFrame 写一帧并 flush，出错时丢掉缓冲区里写了一半的数据
+func (p *ProtoCodec) flushFrame(data []byte) error {
+	if err := p.writeFrame(data); err != nil {
+		p.buf.Reset(p.conn)
+		return err
+	}
+	return p.buf.Flush()
+}
+
+// isEmptyBody 服务端回写错误时用 struct{}{} 占位，这种情况下写一个空帧
+func isEmptyBody(body interface{}) bool {
+	if body == nil {
+		return true
+	}
+	_, ok := body.(struct{})
+	return ok
+}
+
+func (p *ProtoCodec) readFrame() ([]byte, error) {
+	size, err := binary.ReadUvarint(p.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxProtoFrameSize {
+		return nil, fmt.Errorf("rpc codec: protobuf 帧大小 %d 超过了 %d", size, maxProtoFrameSize)
+	}
+	if uint64(cap(p.frame)) < size {
+		p.frame = make([]byte, size)
+	}
+	p.frame = p.frame[:size]
+	if _, err = io.ReadFull(p.r, p.frame); err != nil {
+		if err == io.EOF { // 读完长度之后遇到 EOF，说明数据不完整
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p.frame, nil
+}
+
+func (p *ProtoCodec) writeFrame(data []byte) error {
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(data)))
+	if _, err := p.buf.Write(size[:n]); err != nil {
+		return err
+	}
+	_, err := p.buf.Write(data)
+	return err
+}
+
+// Header 的字段编号，与上面的 .proto 定义一致
+const (
+	headerServiceMethod protowire.Number = 1
+	headerSeq           protowire.Number = 2
+	headerError         protowire.Number = 3
+	headerMetadata      protowire.Number = 4
+	headerTimeout       protowire.Number = 5
+	headerCancel        protowire.Number = 6
+	headerGoAway        protowire.Number = 7
+
+	// map 的每一项都编码成一个内嵌的消息，key 和 value 分别是 1 号和 2 号字段
+	mapEntryKey   protowire.Number = 1
+	mapEntryValue protowire.Number = 2
+)
+
+func marshalHeader(h *Header) []byte {
+	var b []byte
+	// proto3 的默认值不用编码
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, headerServiceMethod, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, headerSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, headerError, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	// map 的顺序是随机的，排一下序，同样的 Header 每次编码的结果都一样
+	keys := make([]string, 0, len(h.Metadata))
+	for k := range h.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, mapEntryKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, mapEntryValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, h.Metadata[k])
+		b = protowire.AppendTag(b, headerMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, headerTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	if h.Cancel {
+		b = protowire.AppendTag(b, headerCancel, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.Cancel))
+	}
+	if h.GoAway {
+		b = protowire.AppendTag(b, headerGoAway, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.GoAway))
+	}
+	return b
+}
+
+func unmarshalHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == headerServiceMethod && typ == protowire.BytesType:
+			h.ServiceMethod, n = protowire.ConsumeString(b)
+		case num == headerSeq && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == headerError && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == headerMetadata && typ == protowire.BytesType:
+			var entry []byte
+			if entry, n = protowire.ConsumeBytes(b); n >= 0 {
+				if err := unmarshalMapEntry(entry, h); err != nil {
+					return err
+				}
+			}
+		case num == headerTimeout && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = time.Duration(v)
+		case num == headerCancel && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Cancel = protowire.DecodeBool(v)
+		case num == headerGoAway && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.GoAway = protowire.DecodeBool(v)
+		default: // 不认识的字段跳过，方便以后给 Header 加字段
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// unmarshalMapEntry 解码 metadata 中的一项，缺少 key 或者 value 时按空字符串处理，与 protobuf 的 map 一致
+func unmarshalMapEntry(b []byte, h *Header) error {
+	var key, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == mapEntryKey && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(b)
+		case num == mapEntryValue && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	if h.Metadata == nil {
+		h.Metadata = make(map[string]string)
+	}
+	h.Metadata[key] = value
+	return nil
+}
+
+func NewProtoCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtoCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+	}
+}
+
+var _ Framer = &ProtoCodec{}
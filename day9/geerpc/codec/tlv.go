@@ -1,6 +1,7 @@
 package codec
 
 import (
+	"bufio"
 	"io"
 	"log"
 	tlv "tlv/codec"
@@ -12,6 +13,8 @@ type TlvCodec struct {
 	dec *tlv.Decoder // 解码器
 	// 编解码谁呢？连接！
 	conn io.ReadWriteCloser // 连接，所以这个连接会放入上面两个编解码器中
+	// 与 GobCodec 一样，写的时候用带缓冲的 Writer，Header 和 Body 编码完之后一次性 flush
+	buf *bufio.Writer
 }
 
 func (t *TlvCodec) Close() error {
@@ -20,28 +23,30 @@ func (t *TlvCodec) Close() error {
 
 func (g *TlvCodec) ReadHeader(header *Header) error {
 	// 用解码器把 conn（在构造的时候conn已经被放入了 dec）里面的头读出来
+	// 解码失败时返回的是 tlv/codec 中定义的错误（ErrTruncated、*TypeError 等），原样交给调用方
 	return g.dec.Decode(header)
 }
 
 func (g *TlvCodec) ReadBody(body interface{}) error {
-	// 同上
+	// 同上。body 为 nil 时，解码器会把这个 Body 读出来丢掉
 	return g.dec.Decode(body)
 }
 
 func (g *TlvCodec) Write(header *Header, body interface{}) (err error) {
 	defer func() {
+		_ = g.buf.Flush()
 		if err != nil { // 判断写入的过程有没有发生错误，有的话，关闭连接
 			_ = g.conn.Close()
 		}
 	}()
 	// 写方法就需要编码器，进行写入了
 	if er := g.enc.Encode(header); er != nil {
-		log.Println("GobCodec: 写入 header 失败：", er) // 出现 error 的地方，我们记录一下
+		log.Println("TlvCodec: 写入 header 失败：", er) // 出现 error 的地方，我们记录一下
 		return er
 	}
 	// 上下两种写法是等价的，两个 错误 都是新的变量，在 return 的时候会被写到 返回值 err 中，然后再执行 defer
 	if err := g.enc.Encode(body); err != nil {
-		log.Println("GobCodec: 写入 body 失败：", err)
+		log.Println("TlvCodec: 写入 body 失败：", err)
 		return err
 	}
 	// 最后，因为 enc 里面使用的是带缓冲的 Writer，所以需要 flush 一下
@@ -49,13 +54,35 @@ func (g *TlvCodec) Write(header *Header, body interface{}) (err error) {
 	return nil
 }
 
+// WriteHeader 与 Write 不同，只写 Header，写完立即 flush，出错时也不关闭连接，给 FrameCodec 使用
+func (g *TlvCodec) WriteHeader(header *Header) error {
+	return g.encode(header)
+}
+
+// WriteBody 只写 Body，同上
+func (g *TlvCodec) WriteBody(body interface{}) error {
+	return g.encode(body)
+}
+
+// encode 编码一个值并 flush，出错时丢掉缓冲区里写了一半的数据
+func (g *TlvCodec) encode(v interface{}) error {
+	if err := g.enc.Encode(v); err != nil {
+		g.buf.Reset(g.conn)
+		return err
+	}
+	return g.buf.Flush()
+}
+
 // NewTlvCodec 类型定义好了，接着可以定义他的构造函数了
 func NewTlvCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
 	return &TlvCodec{
 		conn: conn,
-		enc:  tlv.NewEncoder(conn), // enc 是编码器，用来写的，所以我们把 buf 丢进去，以提高效率
-		dec:  tlv.NewDecoder(conn),
+		buf:  buf,
+		enc:  tlv.NewEncoder(buf), // enc 是编码器，用来写的，所以我们把 buf 丢进去，以提高效率
+		// 解码器读 T 和 L 的时候是一个字节一个字节读的，直接读 conn 的话每个字节都是一次系统调用，所以也套一层缓冲
+		dec: tlv.NewDecoder(bufio.NewReader(conn)),
 	}
 }
 
-var _ Codec = &TlvCodec{}
\ No newline at end of file
+var _ Framer = &TlvCodec{}
\ No newline at end of file
@@ -0,0 +1,249 @@
+package geerpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geerpc/codec"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+	"tlv/wire"
+)
+
+/*
+握手：客户端连上来之后先发送 Option，服务端检查之后回一个应答，之后才开始收发 Header 和 Body。
+最早 Option 是用 json 编码的，服务端用 json.Decoder 直接从连接上读，而 json.Decoder 会多读一些数据到自己的缓冲区里，
+客户端只能等服务端应答之后再发请求，否则紧跟在 Option 后面的 Header 就被 json.Decoder 吞掉了（见 NewClient 中的注释）。
+现在改成二进制的握手，开头是固定长度的头部，后面是指定长度的内容，服务端每次都正好读出需要的字节数，不会多读，
+所以客户端发出握手之后不用等应答，紧接着就可以发送第一个请求，建立连接不再多一个来回。
+服务端的应答由客户端的接收协程在读第一个响应之前读出来：
+
+
+	| 魔数（4 字节） | 版本（1 字节） | 长度（2 字节） | 内容（长度个字节） |
+
+魔数就是大端序的 MagicNumber，第一个字节是 0，而 json 编码的 Option 以 '{' 开头，服务端据此区分新老客户端。
+版本 1 的请求内容：
+
+	| 编码方式（1） | 压缩方式（1） | 标志位（1） | 连接超时（8） | 处理超时（8） | 压缩阈值（4） | 编码名长度（1） | 编码名 |
+
+编码方式是内置编码的编号，通过 codec.Register 注册的编码方式编号为 0，这时编码名就是它的 codec.Type；
+标志位目前只用了最低位，表示是否开启分帧（见 codec.FrameCodec），不认识的位直接忽略；
+超时时间是纳秒数。以后的版本只能在末尾追加字段，老的服务端按照长度跳过不认识的部分。
+应答的格式相同，内容是：
+
+	| 状态（1 字节） | 错误信息 |
+
+状态为 0 表示握手成功，否则服务端在发送错误信息之后关闭连接，客户端已经发出的请求都以这个错误结束。
+*/
+
+// 握手的格式由 tlv/wire 定义，tlvdump 也用同一份常量
+const (
+	handshakeVersion    = wire.Version
+	handshakeHeaderSize = wire.HeaderSize // 魔数 + 版本 + 长度
+	handshakeFixedSize  = wire.OptionSize // 请求内容中编码名之前的部分
+)
+
+// 握手应答的状态
+const (
+	handshakeOK       = wire.StatusOK
+	handshakeRejected = wire.StatusRejected
+)
+
+// 标志位
+const (
+	flagFraming = wire.FlagFraming // 开启分帧
+)
+
+// codecIDs 内置编码方式的编号，一旦确定就不能再改
+var codecIDs = map[codec.Type]byte{
+	codec.GobType:     wire.CodecGob,
+	codec.JsonType:    wire.CodecJson,
+	codec.TlvType:     wire.CodecTlv,
+	codec.ProtoType:   wire.CodecProto,
+	codec.MsgpackType: wire.CodecMsgpack,
+}
+
+var errBadHandshake = errors.New("rpc: 握手数据格式错误")
+
+// newHandshake 分配一个内容长度为 size 的握手消息，并填好头部
+func newHandshake(size int) []byte {
+	b := make([]byte, handshakeHeaderSize+size)
+	binary.BigEndian.PutUint32(b, MagicNumber)
+	b[4] = handshakeVersion
+	binary.BigEndian.PutUint16(b[5:], uint16(size))
+	return b
+}
+
+// marshalOption 把 Option 编码成二进制的握手请求
+func marshalOption(opt *Option) ([]byte, error) {
+	comp, ok := codec.CompressionID(opt.Compression)
+	if !ok {
+		return nil, fmt.Errorf("invalid compression %s", opt.Compression)
+	}
+	var name string
+	id, ok := codecIDs[opt.CodecType]
+	if !ok {
+		name = string(opt.CodecType)
+		if name == "" || len(name) > 0xff {
+			return nil, fmt.Errorf("invalid codec type %s", opt.CodecType)
+		}
+	}
+	threshold := opt.CompressThreshold
+	if threshold < 0 || threshold > 1<<31-1 {
+		threshold = 0
+	}
+	var flags byte
+	if opt.Framing {
+		flags |= flagFraming
+	}
+	b := newHandshake(handshakeFixedSize + len(name))
+	payload := b[handshakeHeaderSize:]
+	payload[0], payload[1], payload[2] = id, comp, flags
+	binary.BigEndian.PutUint64(payload[3:], uint64(opt.ConnectTimeout))
+	binary.BigEndian.PutUint64(payload[11:], uint64(opt.HandleTimeout))
+	binary.BigEndian.PutUint32(payload[19:], uint32(threshold))
+	payload[23] = byte(len(name))
+	copy(payload[handshakeFixedSize:], name)
+	return b, nil
+}
+
+// unmarshalOption 解码握手请求的内容
+func unmarshalOption(payload []byte, opt *Option) error {
+	if len(payload) < handshakeFixedSize {
+		return errBadHandshake
+	}
+	compression, ok := codec.CompressionByID(payload[1])
+	if !ok {
+		return fmt.Errorf("rpc: unsupported compression id %d", payload[1])
+	}
+	*opt = Option{
+		MagicNumber:       MagicNumber,
+		Compression:       compression,
+		Framing:           payload[2]&flagFraming != 0,
+		ConnectTimeout:    time.Duration(binary.BigEndian.Uint64(payload[3:])),
+		HandleTimeout:     time.Duration(binary.BigEndian.Uint64(payload[11:])),
+		CompressThreshold: int(binary.BigEndian.Uint32(payload[19:])),
+	}
+	nameLen := int(payload[23])
+	if len(payload) < handshakeFixedSize+nameLen {
+		return errBadHandshake
+	}
+	if payload[0] == 0 {
+		opt.CodecType = codec.Type(payload[handshakeFixedSize : handshakeFixedSize+nameLen])
+		return nil
+	}
+	for typ, id := range codecIDs {
+		if id == payload[0] {
+			opt.CodecType = typ
+			return nil
+		}
+	}
+	return fmt.Errorf("rpc: unknown codec id %d", payload[0])
+}
+
+// readHandshake 读出一个完整的握手消息，返回它的内容。prefix 是已经从 r 中读出来的开头部分
+func readHandshake(r io.Reader, prefix []byte) ([]byte, error) {
+	header := make([]byte, handshakeHeaderSize)
+	if _, err := io.ReadFull(r, header[copy(header, prefix):]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(header) != MagicNumber {
+		return nil, fmt.Errorf("rpc: invalid magic number %x", header[:4])
+	}
+	if header[4] < handshakeVersion {
+		return nil, fmt.Errorf("rpc: unsupported handshake version %d", header[4])
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// readOption 服务端读出客户端发来的 Option，legacy 表示是老的客户端，用的是 json
+func readOption(conn io.Reader) (opt *Option, legacy bool, err error) {
+	first := make([]byte, 1)
+	if _, err = io.ReadFull(conn, first); err != nil {
+		return nil, false, err
+	}
+	opt = new(Option)
+	if first[0] == '{' {
+		// 老的客户端会等到服务端应答之后才发送请求，json.Decoder 多读也读不到什么
+		err = json.NewDecoder(io.MultiReader(bytes.NewReader(first), conn)).Decode(opt)
+		if err == nil && opt.MagicNumber != MagicNumber {
+			err = fmt.Errorf("rpc: invalid magic number %x", opt.MagicNumber)
+		}
+		return opt, true, err
+	}
+	payload, err := readHandshake(conn, first)
+	if err != nil {
+		return nil, false, err
+	}
+	return opt, false, unmarshalOption(payload, opt)
+}
+
+// writeOptionReply 服务端应答客户端，reject 不为空时表示拒绝这次握手
+func writeOptionReply(conn io.Writer, opt *Option, legacy bool, reject error) error {
+	if legacy {
+		if reject != nil { // 老的客户端没有办法接收错误信息，直接关闭连接
+			return nil
+		}
+		return json.NewEncoder(conn).Encode(opt)
+	}
+	var msg string
+	if reject != nil {
+		if msg = reject.Error(); len(msg) > 0xfffe {
+			msg = msg[:0xfffe]
+		}
+	}
+	b := newHandshake(1 + len(msg))
+	b[handshakeHeaderSize] = handshakeOK
+	if reject != nil {
+		b[handshakeHeaderSize] = handshakeRejected
+		copy(b[handshakeHeaderSize+1:], msg)
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+// writeHandshake 客户端发送 Option，不等服务端的应答
+func writeHandshake(conn io.Writer, opt *Option) error {
+	b, err := marshalOption(opt)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// readHandshakeReply 客户端读出服务端对握手的应答，被拒绝的话返回服务端给出的原因
+func readHandshakeReply(conn io.Reader) error {
+	payload, err := readHandshake(conn, nil)
+	if err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return errBadHandshake
+	}
+	if payload[0] != handshakeOK {
+		return fmt.Errorf("rpc: handshake rejected: %s", payload[1:])
+	}
+	return nil
+}
+
+// rejectLinger 拒绝握手之后最多等多久客户端关闭连接
+const rejectLinger = time.Second
+
+// closeRejected 关闭拒绝了握手的连接。客户端不等应答就会把请求发过来，服务端没读的数据还留在连接上时直接关闭，
+// 内核会回一个 RST，客户端可能还没读到拒绝的原因就被重置了。所以先关闭写的一方，把客户端发来的数据读完再关闭
+func closeRejected(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(rejectLinger))
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,89 @@
+package geerpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// 拦截器：鉴权、日志、监控、参数校验这类每个方法都要做的事情，不用再复制到每个服务方法里面，
+// 通过 WithInterceptors 装到 Server 上，所有请求在调用服务方法之前都会依次经过它们。
+// 拦截器返回的错误和服务方法返回的错误一样，会写到响应 Header 的 Error 中，不调用 handler 直接返回错误就能拦下这次调用
+
+// UnaryServerInfo 拦截器能拿到的这次调用的信息
+type UnaryServerInfo struct {
+	ServiceMethod string            // 服务.方法
+	Metadata      map[string]string // 请求带来的元数据，不要修改
+	Reply         interface{}       // 返回值（指针），handler 返回之后里面才有结果
+}
+
+// UnaryHandler 调用链的下一环，最后一环调用的是服务方法本身。args 的类型要与服务方法的参数一致
+type UnaryHandler func(ctx context.Context, args interface{}) error
+
+// UnaryServerInterceptor 拦截器，在 handler 前后加上自己的逻辑，也可以不调用 handler 直接返回错误
+type UnaryServerInterceptor func(ctx context.Context, info *UnaryServerInfo, args interface{}, handler UnaryHandler) error
+
+// WithInterceptors 给 Server 装上拦截器，按传入的顺序调用，第一个在最外层。多次使用时追加在后面
+func WithInterceptors(interceptors ...UnaryServerInterceptor) ServerOption {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// invoke 让请求依次经过拦截器，最后调用服务方法
+func (s *Server) invoke(ctx context.Context, req *request) error {
+	if len(s.interceptors) == 0 {
+		return req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+	}
+	md, _ := MetadataFromContext(ctx)
+	info := &UnaryServerInfo{
+		ServiceMethod: req.h.ServiceMethod,
+		Metadata:      md,
+		Reply:         req.replyv.Interface(),
+	}
+	handler := func(ctx context.Context, args interface{}) error {
+		// 拦截器可以换掉参数，但类型得跟原来的一样
+		argv := reflect.ValueOf(args)
+		if !argv.IsValid() || argv.Type() != req.argv.Type() {
+			return fmt.Errorf("rpc server: %s expects args of type %s, got %T", req.h.ServiceMethod, req.argv.Type(), args)
+		}
+		return req.svc.call(ctx, req.mtype, argv, req.replyv)
+	}
+	// 从最后一个拦截器开始往外包，第一个拦截器在最外层
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := s.interceptors[i], handler
+		handler = func(ctx context.Context, args interface{}) error {
+			return interceptor(ctx, info, args, next)
+		}
+	}
+	return handler(ctx, req.argv.Interface())
+}
+
+// 客户端同样可以装上拦截器，重试、日志、统一带上鉴权的元数据都可以放在这里。
+// 拦截器放在 Option.Interceptors 中，Dial 出来的 Client 和 NewXClient 创建的 XClient 的每次调用都会经过它们：
+// 拦截器可以换掉参数、用 WithMetadata 生成新的 ctx 带上元数据、多次调用 invoker 来重试，或者不调用 invoker 直接返回错误
+
+// UnaryClientInfo 客户端拦截器能拿到的这次调用的信息
+type UnaryClientInfo struct {
+	ServiceMethod string            // 服务.方法
+	Addr          string            // 这次调用选中的服务端地址
+	Metadata      map[string]string // ctx 中要随请求发送的元数据，要修改的话用 WithMetadata 生成新的 ctx 交给 invoker
+}
+
+// UnaryInvoker 调用链的下一环，最后一环真正把请求发出去并等待结果
+type UnaryInvoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// UnaryClientInterceptor 客户端拦截器，在 invoker 前后加上自己的逻辑
+type UnaryClientInterceptor func(ctx context.Context, info *UnaryClientInfo, args, reply interface{}, invoker UnaryInvoker) error
+
+// ChainUnaryClient 让调用依次经过 interceptors，最后调用 invoker，第一个拦截器在最外层。addr 是这次调用选中的服务端地址
+func ChainUnaryClient(interceptors []UnaryClientInterceptor, addr string, invoker UnaryInvoker) UnaryInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			info := &UnaryClientInfo{ServiceMethod: serviceMethod, Addr: addr, Metadata: outgoingMetadata(ctx)}
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return invoker
+}
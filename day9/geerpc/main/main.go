@@ -23,7 +23,7 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 	listener, _ := net.Listen("tcp", ":0")
 	server := geerpc.NewServer()
 	server.Register(new(Foo))
-	registry.Heartbeat(registryAddr, "tcp@" + listener.Addr().String(), 0)
+	registry.Register(server, registryAddr, "tcp@" + listener.Addr().String(), 0)
 	wg.Done()
 	server.Accept(listener)
 }
@@ -68,8 +68,9 @@ func broadcast(registry string) {
 				Num2: i * i,
 			}
 			foo(xc, context.Background(), "broadcast", "Foo.Sum", args)
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 			foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
+			cancel()
 		}(i)
 	}
 	wg.Wait()
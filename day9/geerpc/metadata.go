@@ -0,0 +1,101 @@
+package geerpc
+
+import (
+	"context"
+	"sync"
+)
+
+// 元数据：请求 ID、鉴权的 token、租户 ID、链路追踪的上下文这类不属于参数的信息放在 codec.Header 的 Metadata 中，
+// 请求和响应都可以带。客户端和服务端都通过 context 来读写：
+//   - 客户端：WithMetadata 设置 Call 发给服务端的元数据，WithReplyMetadata 接收服务端在响应中带回的元数据
+//   - 服务端：方法的第一个参数是 context.Context 时，MetadataFromContext 读出请求带来的元数据，SetReplyMetadata 设置响应的元数据
+// 服务端读到的元数据与客户端要发送的元数据放在不同的 key 下面，服务方法拿着自己的 ctx 去调用别的服务时，
+// 不会把收到的 token 之类的东西原样转发出去，需要的话用 WithMetadata 显式地带上
+
+type (
+	outgoingKey  struct{} // 客户端要发送的元数据
+	incomingKey  struct{} // 服务端收到的元数据
+	replyKey     struct{} // 客户端接收响应元数据的位置
+	collectorKey struct{} // 服务端要在响应中带回的元数据
+)
+
+// WithMetadata 返回一个新的 context，用它调用 Client.Call 时会带上 md。多次调用时合并，后设置的覆盖先设置的
+func WithMetadata(ctx context.Context, md map[string]string) context.Context {
+	old, _ := ctx.Value(outgoingKey{}).(map[string]string)
+	merged := make(map[string]string, len(old)+len(md))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, outgoingKey{}, merged)
+}
+
+// outgoingMetadata 客户端要发送的元数据
+func outgoingMetadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(outgoingKey{}).(map[string]string)
+	return md
+}
+
+// WithReplyMetadata 返回一个新的 context，用它调用 Client.Call 时，服务端在响应中带回的元数据会放到 *md 中
+func WithReplyMetadata(ctx context.Context, md *map[string]string) context.Context {
+	return context.WithValue(ctx, replyKey{}, md)
+}
+
+// replyMetadataPtr 客户端接收响应元数据的位置，没有设置时为 nil
+func replyMetadataPtr(ctx context.Context) *map[string]string {
+	md, _ := ctx.Value(replyKey{}).(*map[string]string)
+	return md
+}
+
+// MetadataFromContext 服务端读出请求带来的元数据，不要修改返回的 map
+func MetadataFromContext(ctx context.Context) (map[string]string, bool) {
+	md, ok := ctx.Value(incomingKey{}).(map[string]string)
+	return md, ok
+}
+
+// replyMetadata 服务端在处理请求的过程中收集响应的元数据，方法里面可能会开协程，所以要加锁
+type replyMetadata struct {
+	mu sync.Mutex
+	md map[string]string
+}
+
+// SetReplyMetadata 服务端设置响应中带回的元数据。ctx 必须是服务方法收到的 context，否则返回 false
+func SetReplyMetadata(ctx context.Context, key, value string) bool {
+	r, ok := ctx.Value(collectorKey{}).(*replyMetadata)
+	if !ok {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.md == nil {
+		r.md = make(map[string]string)
+	}
+	r.md[key] = value
+	return true
+}
+
+// newIncomingContext 服务端为一个请求创建 context，带上请求的元数据和收集响应元数据的位置
+func newIncomingContext(ctx context.Context, md map[string]string) (context.Context, *replyMetadata) {
+	r := &replyMetadata{}
+	ctx = context.WithValue(ctx, collectorKey{}, r)
+	if md != nil {
+		ctx = context.WithValue(ctx, incomingKey{}, md)
+	}
+	return ctx, r
+}
+
+// metadata 取出收集到的响应元数据。返回的是一份拷贝，超时的时候方法可能还在继续设置
+func (r *replyMetadata) metadata() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.md == nil {
+		return nil
+	}
+	md := make(map[string]string, len(r.md))
+	for k, v := range r.md {
+		md[k] = v
+	}
+	return md
+}
@@ -0,0 +1,56 @@
+package geerpc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"sync/atomic"
+)
+
+// panic 恢复：服务方法（以及拦截器）是在处理请求的协程里通过反射调用的，其中一个 panic 了，整个服务端进程连同其他所有连接都会挂掉。
+// 所以每个请求都单独 recover，panic 变成这个请求的错误写回 Header.Error，记到方法的统计中，再交给 WithPanicHook 设置的钩子
+
+// PanicInfo 服务方法 panic 时的信息
+type PanicInfo struct {
+	ServiceMethod string      // 服务.方法
+	Value         interface{} // recover() 拿到的值
+	Stack         []byte      // panic 时的调用栈
+}
+
+// WithPanicHook 服务方法 panic 时调用 hook，比如上报到监控系统。hook 在处理请求的协程里同步调用，不要阻塞太久
+func WithPanicHook(hook func(ctx context.Context, info *PanicInfo)) ServerOption {
+	return func(s *Server) {
+		s.panicHook = hook
+	}
+}
+
+// WithDebug 调试模式：服务方法 panic 时把调用栈也写到响应的错误信息中。调用栈会暴露服务端的代码细节，不要在生产环境中打开
+func WithDebug() ServerOption {
+	return func(s *Server) {
+		s.debug = true
+	}
+}
+
+// safeInvoke 与 invoke 一样，只是服务方法 panic 的时候不会让整个进程挂掉，而是返回一个错误
+func (s *Server) safeInvoke(ctx context.Context, req *request) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		// 与 net/http 一样，只取当前协程的调用栈，64KB 足够看到出问题的地方了
+		stack := make([]byte, 64<<10)
+		stack = stack[:runtime.Stack(stack, false)]
+		atomic.AddUint64(&req.mtype.numPanics, 1)
+		log.Printf("rpc server: panic serving %s: %v\n%s", req.h.ServiceMethod, r, stack)
+		if s.panicHook != nil {
+			s.panicHook(ctx, &PanicInfo{ServiceMethod: req.h.ServiceMethod, Value: r, Stack: stack})
+		}
+		err = fmt.Errorf("rpc server: panic serving %s: %v", req.h.ServiceMethod, r)
+		if s.debug {
+			err = fmt.Errorf("%w\n%s", err, stack)
+		}
+	}()
+	return s.invoke(ctx, req)
+}
@@ -0,0 +1,27 @@
+package geerpc
+
+import (
+	"context"
+	"geerpc/codec"
+	"net"
+)
+
+// Peer 发起请求的客户端的信息，服务方法可以用 PeerFromContext 从 ctx 中拿到
+type Peer struct {
+	Addr      net.Addr   // 客户端的地址
+	LocalAddr net.Addr   // 服务端接收这个连接的地址
+	CodecType codec.Type // 握手时协商的编码方式
+}
+
+type peerKey struct{}
+
+// withPeer 服务端为每个连接创建的 context 都带上 Peer，这个连接上所有请求的 context 都由它派生出来
+func withPeer(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// PeerFromContext 服务端读出发起请求的客户端的信息，不要修改返回的 Peer
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
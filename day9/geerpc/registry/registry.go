@@ -1,6 +1,8 @@
 package registry
 
 import (
+	"context"
+	"geerpc"
 	"log"
 	"net/http"
 	"sort"
@@ -129,6 +131,13 @@ func (g *GeeRegistry) putServer(addr string) {
 	}
 }
 
+// removeServer 服务器要关闭了，主动注销，不用等它超时
+func (g *GeeRegistry) removeServer(addr string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.servers, addr)
+}
+
 func (g *GeeRegistry) aliveServers() []string {
 	g.mu.Lock()
 	defer g.mu.Unlock()
@@ -152,6 +161,7 @@ var _ http.Handler = (*GeeRegistry)(nil)
 
 // Get：返回所有可用的服务列表，通过自定义字段 X-Geerpc-Servers 承载。
 // Post：添加服务实例或发送心跳，通过自定义字段 X-Geerpc-Server 承载。
+// Delete：注销服务实例，同样通过 X-Geerpc-Server 承载。
 func (g *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -165,6 +175,13 @@ func (g *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		g.putServer(addr)
+	case http.MethodDelete:
+		addr := req.Header.Get("X-Geerpc-Server")
+		if addr == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		g.removeServer(addr)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -188,6 +205,11 @@ func HandleHTTP() {
 
 // Heartbeat registry 注册中心地址，addr 服务地址
 func Heartbeat(registry, addr string, duration time.Duration) {
+	heartbeat(registry, addr, duration, nil)
+}
+
+// heartbeat 与 Heartbeat 一样，stop 关闭之后停止发送心跳
+func heartbeat(registry, addr string, duration time.Duration, stop <-chan struct{}) {
 	if duration == 0 {
 		//  没给超时时间的话，就以默认的超时间发一次，但是不能卡着点发，因为发送还需要时间
 		duration = defaultTimeout - time.Duration(1) * time.Minute
@@ -195,13 +217,46 @@ func Heartbeat(registry, addr string, duration time.Duration) {
 	err := sendHeartbeat(registry, addr)
 	go func() {
 		ticker := time.NewTicker(duration) // 来一个计时器
+		defer ticker.Stop()
 		for err == nil { // 没有错误就循环定时发送心跳
-			<- ticker.C
-			err = sendHeartbeat(registry, addr)
+			select {
+			case <-ticker.C:
+				err = sendHeartbeat(registry, addr)
+			case <-stop:
+				return
+			}
 		}
 	}()
 }
 
+// Register 向注册中心注册 server 并定时发送心跳。server 优雅关闭（Shutdown）时停止心跳并从注册中心注销，
+// 客户端的服务发现刷新之后就不会再选到它了
+func Register(server *geerpc.Server, registry, addr string, duration time.Duration) {
+	stop := make(chan struct{})
+	heartbeat(registry, addr, duration, stop)
+	server.RegisterOnShutdown(func(ctx context.Context) {
+		close(stop)
+		_ = Deregister(ctx, registry, addr)
+	})
+}
+
+// Deregister 从注册中心注销服务，注册中心一直没有响应的话最多等到 ctx 结束
+func Deregister(ctx context.Context, registry, addr string) error {
+	log.Println(addr, "deregister from registry", registry)
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, registry, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Geerpc-Server", addr)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Println("rpc server: deregister err: ", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
 // 向注册中心发送心跳
 
 func sendHeartbeat(registry, addr string) error {
@@ -1,7 +1,7 @@
 package geerpc
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"geerpc/codec"
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"tlv/wire"
 )
 
 /*
@@ -36,16 +37,16 @@ import (
 */
 
 // MagicNumber geerpc报文的魔数
-const MagicNumber = 0x3bef5c
+const MagicNumber = wire.Magic
 
 /*
 既然有多个编解码器，那么就需要请求中有一定的字段来标识请求内容放是用什么编码的
 为了提升性能，一般在报文的最开始会规划固定的字节，来协商相关的信息。
 比如第 1 个字节用来表示序列化方式，第 2 个字节表示压缩方式，第 3-6 字节表示 header 的长度，7-10 字节表示 body 的长度
-在这里，我们简单将其封装为 Option 类，并使用 json 来编码（就不使用字节来区分了）
+在这里，我们将其封装为 Option 类，最早使用 json 来编码，现在改成了固定格式的二进制握手（见 handshake.go），json 编码的 Option 仍然兼容
 即，报文的格式如下所示：
 | Option{MagicNumber: xxx, CodecType: xxx} | Header{ServiceMethod ...} | Body interface{} |
-| <------      固定 JSON 编码      ------>  | <-------    编码方式由 CodeType 决定    ------->|
+| <------      二进制握手       ------>     | <-------    编码方式由 CodeType 决定    ------->|
 在一次连接中，Option 固定在报文的最开始，Header 和 Body 可以有多个，即报文可能是这样的：
 | Option | Header1 | Body1 | Header2 | Body2 | ...
 */
@@ -58,6 +59,31 @@ type Option struct {
 	// 因为超时时间应该也是由 Client 和 Server 协商来的，所以将超时时间字段放入 Option 中
 	ConnectTimeout time.Duration // 连接超时
 	HandleTimeout  time.Duration // 处理超时
+
+	// 压缩方式，序列化之后不小于 CompressThreshold 字节的消息才压缩，CompressThreshold <= 0 时使用 codec.DefaultCompressThreshold
+	Compression       codec.Compression
+	CompressThreshold int
+
+	// Framing 为 true 时每个消息前面都带上 Header 和 Body 的长度（见 codec.FrameCodec）
+	Framing bool
+	// MaxMessageSize 分帧时客户端能接收的最大消息，<= 0 时使用 codec.DefaultMaxMessageSize。只在本地使用，不会发给服务端
+	MaxMessageSize int `json:"-"`
+	// Interceptors 客户端的拦截器，每次调用都会按顺序经过它们（见 interceptor.go）。只在本地使用，不会发给服务端
+	Interceptors []UnaryClientInterceptor `json:"-"`
+}
+
+// newCodec 按照 Option 创建 Codec，需要分帧、压缩的话在外面再包一层，maxSize 是分帧时能接收的最大消息
+func newCodec(f codec.NewCodecFunc, conn io.ReadWriteCloser, opt *Option, maxSize int) (codec.Codec, error) {
+	if opt.Framing {
+		newInner := f
+		f = func(conn io.ReadWriteCloser) codec.Codec {
+			return codec.NewFrameCodec(newInner, conn, maxSize)
+		}
+	}
+	if opt.Compression == codec.CompressNone {
+		return f(conn), nil
+	}
+	return codec.NewCompressCodec(f, conn, opt.Compression, opt.CompressThreshold)
 }
 
 // DefaultOption 客户端要是没传Option，我们就用这个默认的
@@ -70,18 +96,94 @@ var DefaultOption = &Option{
 // Server 既然前面加上面，对通信的细节已经敲定了。那么就可以编写服务了
 type Server struct {
 	serviceMap sync.Map
+	codecs     map[codec.Type]struct{} // 允许客户端使用的编码方式，为空时注册过的都可以用
+	maxMsgSize int                     // 分帧时能接收的最大消息
+
+	methodTimeouts map[string]time.Duration // 服务端给方法设置的处理超时
+
+	interceptors []UnaryServerInterceptor // 调用服务方法之前依次经过的拦截器
+	panicHook    func(ctx context.Context, info *PanicInfo)
+	debug        bool // 调试模式，panic 时把调用栈写到响应的错误信息中
+
+	// 优雅关闭用到的状态（见 shutdown.go）
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	connWg     sync.WaitGroup
+	inShutdown bool
+	onShutdown []func(ctx context.Context)
 }
 
-func NewServer() *Server {
-	return &Server{}
+// ServerOption 创建 Server 时的可选配置
+type ServerOption func(s *Server)
+
+// WithCodecs 限制客户端在 Option 中只能选择这几种编码方式，其他的在握手时直接拒绝
+func WithCodecs(types ...codec.Type) ServerOption {
+	return func(s *Server) {
+		s.codecs = make(map[codec.Type]struct{}, len(types))
+		for _, typ := range types {
+			s.codecs[typ] = struct{}{}
+		}
+	}
+}
+
+// WithMethodTimeout 服务端给 serviceMethod（服务.方法）设置的处理超时，超时之后方法的 ctx 被取消，客户端收到超时的错误。
+// 客户端在 Option 中也设置了 HandleTimeout 的话，取较短的那个。
+// 只有带 ctx 的方法能据此停下来，不带 ctx 的方法超时之后仍然会执行到结束，只是结果不再发给客户端
+func WithMethodTimeout(serviceMethod string, timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		if s.methodTimeouts == nil {
+			s.methodTimeouts = make(map[string]time.Duration)
+		}
+		s.methodTimeouts[serviceMethod] = timeout
+	}
+}
+
+// handleTimeout 一个请求的处理超时：客户端协商的 HandleTimeout 和服务端给这个方法设置的超时，取较短的那个，0 表示不限
+func (s *Server) handleTimeout(serviceMethod string, timeout time.Duration) time.Duration {
+	if d := s.methodTimeouts[serviceMethod]; d > 0 && (timeout <= 0 || d < timeout) {
+		return d
+	}
+	return timeout
+}
+
+// WithMaxMessageSize 客户端开启分帧时，服务端能接收的最大消息，超过的话直接关闭连接
+func WithMaxMessageSize(size int) ServerOption {
+	return func(s *Server) {
+		s.maxMsgSize = size
+	}
+}
+
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *Server) acceptCodec(typ codec.Type) bool {
+	if s.codecs == nil {
+		return true
+	}
+	_, ok := s.codecs[typ]
+	return ok
 }
 
 // Accept 服务端通过 Accept 方法，监听连接，来一个处理一个
 func (s *Server) Accept(lis net.Listener) {
+	// 记下 listener，Shutdown 的时候关掉它，Accept 就返回了
+	if !s.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer s.trackListener(lis, false)
 	for true {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error: ", err)
+			if !s.shuttingDown() {
+				log.Println("rpc server: accept error: ", err)
+			}
 			// 一旦监听失败，直接返回
 			return
 		}
@@ -97,39 +199,61 @@ func (s *Server) Accept(lis net.Listener) {
 
 func (s *Server) ServeConn(conn net.Conn) {
 	defer conn.Close()
-	// 前面注释已经说了，我们的 Option 默认就先用 json 编解码了
-	// TODO Option 编解码换成字节形式
-	// 1. 解码 Option
-	opt := new(Option)
-	if err := json.NewDecoder(conn).Decode(opt); err != nil {
-		log.Println("rpc server: option error: ", err)
+	// 这个连接上所有请求的 context 都从 ctx 派生，连接读写出错时取消
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc := &serverConn{conn: conn, sending: new(sync.Mutex), cancel: cancel}
+	if !s.trackConn(sc, true) { // 已经在关闭了，不再接收新的连接
 		return
 	}
-	// 2. 判断魔数
-	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
+	defer s.trackConn(sc, false)
+	// 1. 解码 Option，新的客户端发送的是二进制的握手，老的客户端发送的是 json（见 handshake.go）
+	// 2. 判断魔数，解码的时候已经判断过了
+	opt, legacy, err := readOption(conn)
+	if err != nil {
+		log.Println("rpc server: option error: ", err)
 		return
 	}
 	// 3. 根据编解码字段解码内容
-	newCodecFunc := codec.NewCodecFuncMap[opt.CodecType]
-	if newCodecFunc == nil {
-		log.Println("rpc server: codec doesn't exist")
+	cc, err := s.newServerCodec(&failConn{Conn: conn, fail: cancel}, opt)
+	if err != nil {
+		log.Println("rpc server: codec error: ", err)
+		_ = writeOptionReply(conn, opt, legacy, err)
+		closeRejected(conn)
 		return
 	}
-	cc := newCodecFunc(conn)
 	// 给客户端一个响应，说明此次 Option 是 ok 的
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+	if err := writeOptionReply(conn, opt, legacy, nil); err != nil {
 		log.Println("rpc server: option error: ", err)
 		return
 	}
-	s.serveCodec(cc, opt.HandleTimeout)
+	if !sc.setCodec(cc) { // 握手的时候开始关闭了
+		return
+	}
+	// 带上客户端的信息
+	ctx = withPeer(ctx, &Peer{Addr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr(), CodecType: opt.CodecType})
+	s.serveCodec(ctx, sc, opt.HandleTimeout)
+}
+
+// newServerCodec 检查客户端选择的编码方式，并创建对应的 Codec
+func (s *Server) newServerCodec(conn net.Conn, opt *Option) (codec.Codec, error) {
+	if !s.acceptCodec(opt.CodecType) {
+		return nil, fmt.Errorf("codec %s not accepted", opt.CodecType)
+	}
+	newCodecFunc, ok := codec.Lookup(opt.CodecType)
+	if !ok {
+		return nil, fmt.Errorf("codec %s doesn't exist", opt.CodecType)
+	}
+	return newCodec(newCodecFunc, conn, opt, s.maxMsgSize)
 }
 
 var invalidRequest = struct{}{}
 
-func (s *Server) serveCodec(cc codec.Codec, timeout time.Duration) {
+func (s *Server) serveCodec(ctx context.Context, sc *serverConn, timeout time.Duration) {
+	cc := sc.cc
 	wg := new(sync.WaitGroup)
-	sending := new(sync.Mutex)
+	sending := sc.sending
+	requests := &inflight{cancels: make(map[uint64]context.CancelFunc)}
 	// 由前面的注释可知，一次连接中，可能有多个 header、body 对，那么需要循环取出，并进行处理
 	for true {
 		// 解析出一对 Header Body
@@ -138,6 +262,11 @@ func (s *Server) serveCodec(cc codec.Codec, timeout time.Duration) {
 			if req == nil {
 				// req 也为空的话，是读取 Header 出了问题，也就说明这个连接出现了问题。这是没办法恢复的，所以只能 break，关闭连接了
 				// log.Println("rpc server: resolve request fail: ", err)
+				// 客户端正常关闭连接（或者只关闭了写的一方）时读到的是 io.EOF，已经收到的请求照常处理、发送响应。
+				// 其他错误说明连接坏了，响应也发不回去，取消还在处理的请求，不用再做下去了
+				if err != io.EOF {
+					sc.cancel()
+				}
 				break
 			}
 			// req 不为空，Header 没有问题，但是出现了其他错误（service 查找失败、Body 读取失败），那么我么可以往回写入错误信息
@@ -145,18 +274,58 @@ func (s *Server) serveCodec(cc codec.Codec, timeout time.Duration) {
 			s.sendResponse(cc, req.h, invalidRequest, sending) // 写回
 			continue
 		}
+		if req.h.Cancel {
+			// 客户端不要这个请求的结果了，取消掉还在处理的请求。取消帧本身不需要响应
+			requests.cancel(req.h.Seq)
+			continue
+		}
+		if !sc.tryBegin() { // 关闭时等正在处理的请求都处理完再关闭连接
+			// 已经发过 GOAWAY 了，老版本的客户端、其他语言写的客户端不认识它，还会接着发请求，直接拒绝，
+			// 不然关闭就要等到这些客户端自己断开
+			req.h.Error = errShuttingDown
+			s.sendResponse(cc, req.h, invalidRequest, sending)
+			continue
+		}
+		// 请求的 context 在这里创建并登记，紧跟在后面的取消帧一定能找到它
+		req.timeout = s.handleTimeout(req.h.ServiceMethod, timeout)
+		req.ctx, req.cancel = newRequestContext(ctx, req)
+		if !requests.add(req.h.Seq, req.cancel) {
+			// 取消帧按 Seq 找请求，同一个 Seq 的请求同时只能有一个，后来的直接拒绝
+			req.cancel()
+			req.h.Error = fmt.Sprintf("rpc server: duplicate seq %d: the previous request is still being handled", req.h.Seq)
+			s.sendResponse(cc, req.h, invalidRequest, sending)
+			sc.end()
+			continue
+		}
 		// 每一个请求对，再通过并发进行处理
 		// 因为是在一个连接中，所以需要等所有请求都处理完，才能关闭连接。那么我们需要使用 waitGroup
 		wg.Add(1)
 		// 处理请求需要编解码器，需要加上
 		// 因为使用了 waitGroup，所以要加上
 		// 虽然是并发处理各个 Header Body 对，但是一对 Header 和 Body 是需要原子操作的，所以要对写回进行同步，那么就要加锁
-		go s.handleRequest(cc, req, wg, sending, timeout)
+		go func(req *request) {
+			defer sc.end()
+			s.handleRequest(sc, req, wg, requests)
+		}(req)
 	}
 	wg.Wait()
 	_ = cc.Close()
 }
 
+// failConn 写失败说明连接已经坏了，之后的响应都发不回去了，调用 fail 取消这个连接上还在处理的请求
+type failConn struct {
+	net.Conn
+	fail func()
+}
+
+func (c *failConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.fail()
+	}
+	return n, err
+}
+
 // 从连接中解析出一对正常的 Header 和 Body
 func (s *Server) readRequest(cc codec.Codec) (*request, error) {
 	// 1. 编解码器解码 Header
@@ -166,8 +335,14 @@ func (s *Server) readRequest(cc codec.Codec) (*request, error) {
 	}
 	// Header 读取没问题的话，就可以准备一个 request 了
 	req := &request{h: h}
+	if h.Cancel { // 取消帧没有要调用的方法，Body 也是空的
+		_ = cc.ReadBody(nil)
+		return req, nil
+	}
 	req.svc, req.mtype, err = s.findService(h.ServiceMethod)
 	if err != nil {
+		// 找不到服务也得把与 Header 成对的 Body 读出来丢掉，否则下一次读 Header 时读到的就是这个 Body 了
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
 	req.argv = req.mtype.NewArgv()
@@ -215,57 +390,90 @@ func readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 }
 
 // 读取了 Header 和 Body 后，就需要进行处理了
-func (s *Server) handleRequest(cc codec.Codec, req *request, wg *sync.WaitGroup, sending *sync.Mutex, timeout time.Duration) {
+func (s *Server) handleRequest(sc *serverConn, req *request, wg *sync.WaitGroup, requests *inflight) {
+	cc, sending := sc.cc, sc.sending
 	// 处理的过程当然是根据参数去调用方法了
 	//// 我们这里先简单处理，直接写回一个返回值即可
 	defer wg.Done()
 	// log.Print(req.h, "-", req.argv.Elem())
 
-	// 给 call 和 sendResponse 增加超时处理
-	called := make(chan struct{})
-	sent := make(chan struct{})
-
+	// 服务方法通过 ctx 拿到截止时间、客户端的信息，读请求的元数据、设置响应的元数据。
+	// 超时、客户端取消、连接出错时 ctx 会被取消，handleRequest 返回时也会取消，方法里面开的协程可以据此退出
+	defer requests.remove(req.h.Seq)
+	defer req.cancel()
+	// 响应的 Header 是在请求的 Header 上改的，先把请求的元数据换掉
+	ctx, reply := newIncomingContext(req.ctx, req.h.Metadata)
+	req.h.Metadata = nil
+
+	// 给 call 和 sendResponse 增加超时处理。
+	// 只有这里写响应、改 req.h：调用方法的协程只把结果放进 done，超时之后方法还在跑也碰不到响应。
+	// done 带一个缓冲，超时之后没人接收，方法返回的时候也能放进去，协程不会一直阻塞着泄露掉。
+	// 超时只能让带 ctx 的方法停下来，不带 ctx 的方法会一直执行到结束，所以调用方法的协程单独计数，
+	// 方法真正返回之前，serveCodec 不会关闭连接，Shutdown 也会一直等着它
+	done := make(chan error, 1)
+	wg.Add(1)
+	sc.begin()
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		// 与客户端一样，这里会有内存泄露风险
-		// called <- struct{}{}
-		select {
-		case called <- struct{}{}:
-		default:
-			return
-		}
-		if err != nil {
-			req.h.Error = err.Error()
-			s.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
+		defer wg.Done()
+		defer sc.end()
+		done <- s.safeInvoke(ctx, req)
+	}()
+	// 没有超时、客户端也没有带截止时间时不进行超时处理，调用多长时间就等多长时间，除非客户端取消了或者连接出错了
+	finished, err := waitDone(req.ctx, done)
+	if finished && err != nil && errors.Is(err, req.ctx.Err()) {
+		// 方法是因为 ctx 结束才返回的，没有结果，和没等到它返回一样处理
+		finished = false
+	}
+	if !finished {
+		if req.abandoned() { // 客户端已经不等这个响应了，直接返回
 			return
 		}
-		// req.replyv = reflect.ValueOf(fmt.Sprintf("rpc resp %d", req.h.Seq))
-		s.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		sent <- struct{}{}
-	}()
-	if timeout == 0 { // 不进行超时处理，调用多长时间就等多长时间
-		<-called
-		<-sent
+		// 服务端的处理超时了，告诉客户端。方法可能还在写 replyv，不能把它发出去
+		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", req.timeout)
+		s.sendResponse(cc, req.h, invalidRequest, sending)
 		return
 	}
-	select {
-	case <-time.After(timeout):
-		// 超时了
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		s.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-	case <-called:
-		<-sent
+	req.h.Metadata = reply.metadata()
+	if err != nil {
+		req.h.Error = err.Error()
+		s.sendResponse(cc, req.h, invalidRequest, sending)
+		return
 	}
+	s.sendResponse(cc, req.h, req.replyv.Interface(), sending)
+}
 
+// waitDone 等方法返回或者 ctx 结束，finished 为 false 表示 ctx 先结束了，方法还没有返回
+func waitDone(ctx context.Context, done <-chan error) (finished bool, err error) {
+	select {
+	case err = <-done:
+		return true, err
+	case <-ctx.Done():
+		// 方法和超时同时完成的话 select 随便选一个，方法已经返回了就用它的结果，不算超时
+		select {
+		case err = <-done:
+			return true, err
+		default:
+			return false, nil
+		}
+	}
 }
 
 func (s *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
 	// 保证 Header 和 Body 写入的原子性
 	sending.Lock()
 	defer sending.Unlock()
-	if err := cc.Write(h, body); err != nil {
-		log.Println("rpc server: send response fail: ", err)
+	err := cc.Write(h, body)
+	if err == nil {
+		return
+	}
+	log.Println("rpc server: send response fail: ", err)
+	// 响应没发出去，客户端就一直等着这个 Seq。编码失败、响应太大的时候连接上什么也没写，还可以用，
+	// 把错误放进 Header 再发一个空的响应；这样还发不出去，说明连接已经坏了，关闭连接，客户端的调用都以连接断开结束
+	h.Error = err.Error()
+	h.Metadata = nil
+	if err = cc.Write(h, invalidRequest); err != nil {
+		log.Println("rpc server: send error response fail: ", err)
+		_ = cc.Close()
 	}
 }
 
@@ -275,6 +483,75 @@ type request struct {
 	// 添加两个字段
 	mtype *methodType
 	svc   *service
+
+	ctx      context.Context    // 服务方法收到的 ctx，客户端取消、超时、连接出错时都会被取消
+	cancel   context.CancelFunc // 收到取消帧时调用
+	deadline time.Time          // 客户端带来的截止时间，为零值时客户端没有设置
+	timeout  time.Duration      // 服务端的处理超时，0 表示不限
+}
+
+// newRequestContext 为一个请求创建 context：服务端的处理超时和客户端带来的截止时间，哪个先到按哪个来
+func newRequestContext(ctx context.Context, req *request) (context.Context, context.CancelFunc) {
+	now := time.Now()
+	var deadline time.Time
+	if req.timeout > 0 {
+		deadline = now.Add(req.timeout)
+	}
+	if req.h.Timeout > 0 {
+		req.deadline = now.Add(req.h.Timeout)
+		if deadline.IsZero() || req.deadline.Before(deadline) {
+			deadline = req.deadline
+		}
+	}
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// abandoned 请求的 ctx 已经结束，而且不是因为服务端的处理超时：客户端发了取消帧、客户端的截止时间到了或者连接出错了。
+// 这些情况下客户端都不会再等这个响应，不用发了
+func (r *request) abandoned() bool {
+	switch r.ctx.Err() {
+	case nil:
+		return false
+	case context.DeadlineExceeded:
+		return !r.deadline.IsZero() && !time.Now().Before(r.deadline)
+	default:
+		return true
+	}
+}
+
+// inflight 一个连接上正在处理的请求，收到取消帧时按 Seq 找到并取消
+type inflight struct {
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelFunc
+}
+
+// add 登记一个请求，seq 已经有正在处理的请求时返回 false
+func (f *inflight) add(seq uint64, cancel context.CancelFunc) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.cancels[seq]; ok {
+		return false
+	}
+	f.cancels[seq] = cancel
+	return true
+}
+
+func (f *inflight) remove(seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.cancels, seq)
+}
+
+func (f *inflight) cancel(seq uint64) {
+	f.mu.Lock()
+	cancel, ok := f.cancels[seq]
+	f.mu.Unlock()
+	if ok {
+		cancel()
+	}
 }
 
 // DefaultServer 服务端的处理逻辑完成之后，我们给一个全局默认的服务器，以及一个通过包名就可以启动服务的函数，简化用户使用
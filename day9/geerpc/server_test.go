@@ -0,0 +1,785 @@
+package geerpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"geerpc/codec"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_WithCodecs(t *testing.T) {
+	t.Parallel()
+	s := NewServer(WithCodecs(codec.TlvType, codec.ProtoType))
+	_ = s.Register(new(Bar))
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go s.Accept(l)
+	addr := l.Addr().String()
+
+	t.Run("accepted", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{CodecType: codec.TlvType})
+		_assert(err == nil, "dial: %v", err)
+		defer client.Close()
+		reply := new(int)
+		err = client.Call(context.Background(), "Bar.Double", 2, reply)
+		_assert(err == nil && *reply == 4, "unexpected reply: %d, %v", *reply, err)
+	})
+	t.Run("rejected", func(t *testing.T) {
+		// 客户端不等握手的应答，被拒绝的消息在第一次调用时才拿到
+		client, err := Dial("tcp", addr, &Option{CodecType: codec.GobType})
+		_assert(err == nil, "dial: %v", err)
+		defer client.Close()
+		err = client.Call(context.Background(), "Bar.Double", 2, new(int))
+		_assert(err != nil, "expect the handshake to fail for a codec that isn't accepted")
+	})
+}
+
+func TestServer_handshake(t *testing.T) {
+	t.Parallel()
+	s := NewServer(WithCodecs(codec.GobType, codec.TlvType), WithMaxMessageSize(512))
+	_ = s.Register(new(Bar))
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go s.Accept(l)
+	addr := l.Addr().String()
+
+	// call 在已经握手的连接上调用 Bar.Double
+	call := func(cc codec.Codec, argv int) int {
+		err := cc.Write(&codec.Header{ServiceMethod: "Bar.Double", Seq: 1}, argv)
+		_assert(err == nil, "write: %v", err)
+		h, reply := &codec.Header{}, 0
+		_assert(cc.ReadHeader(h) == nil && h.Error == "", "read header: %+v", h)
+		_assert(cc.ReadBody(&reply) == nil, "read body")
+		return reply
+	}
+
+	t.Run("legacy json option", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		opt := &Option{MagicNumber: MagicNumber, CodecType: codec.GobType}
+		_assert(json.NewEncoder(conn).Encode(opt) == nil, "write option")
+		_assert(json.NewDecoder(conn).Decode(opt) == nil, "read option")
+		reply := call(codec.NewGobCodec(conn), 3)
+		_assert(reply == 6, "unexpected reply: %d", reply)
+	})
+	t.Run("pipelined request", func(t *testing.T) {
+		// 握手和第一个请求一起发出去，服务端不会把请求当成握手的一部分读掉
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		b, err := marshalOption(&Option{CodecType: codec.TlvType})
+		_assert(err == nil, "marshal option: %v", err)
+		buf := &bufferConn{}
+		buf.Write(b)
+		_ = codec.NewTlvCodec(buf).Write(&codec.Header{ServiceMethod: "Bar.Double", Seq: 1}, 5)
+		_, err = conn.Write(buf.Bytes())
+		_assert(err == nil, "write: %v", err)
+		payload, err := readHandshake(conn, nil)
+		_assert(err == nil && len(payload) == 1 && payload[0] == handshakeOK, "handshake: %v, %v", payload, err)
+		cc := codec.NewTlvCodec(conn)
+		h, reply := &codec.Header{}, 0
+		_assert(cc.ReadHeader(h) == nil && cc.ReadBody(&reply) == nil && reply == 10, "unexpected reply: %d", reply)
+	})
+	t.Run("rejected with reason", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{CodecType: codec.JsonType})
+		_assert(err == nil, "dial: %v", err)
+		defer client.Close()
+		for i := 0; i < 2; i++ { // 跟着握手发出去的调用，和收到拒绝之后的调用，都能拿到原因
+			err = client.Call(context.Background(), "Bar.Double", 2, new(int))
+			_assert(err != nil && strings.Contains(err.Error(), "not accepted"), "expect the reason of the rejection, got %v", err)
+		}
+		_assert(!client.IsAvailable(), "client shouldn't be available after the rejection")
+	})
+	t.Run("no extra round trip", func(t *testing.T) {
+		// 服务端在读到第一个请求之前不应答握手，Dial 也能返回，第一个请求紧跟着握手发出来
+		l, _ := net.Listen("tcp", ":0")
+		defer l.Close()
+		errCh := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer conn.Close()
+			opt, _, err := readOption(conn)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			cc := codec.NewTlvCodec(conn)
+			h, argv := &codec.Header{}, 0
+			if err = cc.ReadHeader(h); err == nil {
+				err = cc.ReadBody(&argv)
+			}
+			if err == nil {
+				err = writeOptionReply(conn, opt, false, nil)
+			}
+			if err == nil {
+				err = cc.Write(h, argv*2)
+			}
+			errCh <- err
+		}()
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.TlvType})
+		_assert(err == nil, "dial: %v", err)
+		defer client.Close()
+		reply := new(int)
+		err = client.Call(context.Background(), "Bar.Double", 4, reply)
+		_assert(err == nil && *reply == 8, "unexpected reply: %d, %v", *reply, err)
+		_assert(<-errCh == nil, "server side failed")
+	})
+	t.Run("max message size", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{CodecType: codec.TlvType, Framing: true})
+		_assert(err == nil, "dial: %v", err)
+		defer client.Close()
+		err = client.Call(context.Background(), "Bar.Double", make([]byte, 1024), new(int))
+		_assert(err != nil && !client.IsAvailable(), "expect the server to close the connection, got %v", err)
+	})
+	t.Run("reply too large", func(t *testing.T) {
+		// 响应超过限制时服务端发不出去，改成发一个错误响应，客户端不会一直等着，连接也还能接着用
+		client, err := Dial("tcp", addr, &Option{CodecType: codec.TlvType, Framing: true})
+		_assert(err == nil, "dial: %v", err)
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var reply string
+		err = client.Call(ctx, "Bar.Repeat", 1024, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), codec.ErrMessageTooLarge.Error()), "expect the reply to be too large, got %v", err)
+		n := new(int)
+		err = client.Call(ctx, "Bar.Double", 3, n)
+		_assert(err == nil && *n == 6, "expect the connection to be usable, got %d, %v", *n, err)
+	})
+	t.Run("bad magic number", func(t *testing.T) {
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		_, _ = conn.Write([]byte{1, 2, 3, 4, 1, 0, 0})
+		_, err := conn.Read(make([]byte, 1))
+		_assert(err != nil, "expect the server to close the connection")
+	})
+}
+
+func TestOption_marshal(t *testing.T) {
+	for _, in := range []*Option{
+		{CodecType: codec.TlvType},
+		{CodecType: codec.MsgpackType, Compression: codec.CompressZstd, CompressThreshold: 100,
+			ConnectTimeout: time.Second, HandleTimeout: time.Minute},
+		{CodecType: "application/x-custom", Framing: true},
+	} {
+		b, err := marshalOption(in)
+		_assert(err == nil, "marshal %+v: %v", in, err)
+		payload, err := readHandshake(bytes.NewReader(b), nil)
+		_assert(err == nil, "read handshake: %v", err)
+		out := new(Option)
+		_assert(unmarshalOption(payload, out) == nil, "unmarshal")
+		in.MagicNumber = MagicNumber
+		_assert(reflect.DeepEqual(in, out), "round trip mismatch: %+v %+v", in, out)
+	}
+	_, err := marshalOption(&Option{CodecType: codec.TlvType, Compression: "lz4"})
+	_assert(err != nil, "expect an error for unsupported compression")
+	// 以后的版本在末尾追加的字段会被跳过
+	b, _ := marshalOption(&Option{CodecType: codec.GobType})
+	b = append(b, 1, 2, 3)
+	b[4]++
+	binary.BigEndian.PutUint16(b[5:], uint16(len(b)-handshakeHeaderSize))
+	payload, err := readHandshake(bytes.NewReader(b), nil)
+	out := new(Option)
+	_assert(err == nil && unmarshalOption(payload, out) == nil && out.CodecType == codec.GobType, "newer version: %v", err)
+}
+
+// bufferConn 把 bytes.Buffer 当成连接用
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error { return nil }
+
+func TestWithMetadata(t *testing.T) {
+	ctx := WithMetadata(context.Background(), map[string]string{"a": "1", "b": "2"})
+	ctx2 := WithMetadata(ctx, map[string]string{"b": "3"})
+	md := outgoingMetadata(ctx2)
+	_assert(len(md) == 2 && md["a"] == "1" && md["b"] == "3", "unexpected merged metadata: %v", md)
+	_assert(outgoingMetadata(ctx)["b"] == "2", "the parent context should not be modified")
+	// 服务端收到的元数据不会被当成要发送的元数据
+	in, _ := newIncomingContext(context.Background(), map[string]string{"token": "secret"})
+	_assert(outgoingMetadata(in) == nil, "incoming metadata should not be forwarded")
+	_assert(!SetReplyMetadata(context.Background(), "k", "v"), "expect false outside of a service method")
+}
+
+// Waiter 带 context 的服务，用来观察服务端传给方法的 ctx
+type Waiter struct {
+	done    chan error
+	entered chan struct{} // Hold 开始处理时发一个信号
+	release chan struct{} // 每收到一个值放行一个 Hold
+}
+
+// Wait 一直等到 ctx 被取消，把原因交给测试。done 为空或者上一个原因还没有被取走时丢掉
+func (w *Waiter) Wait(ctx context.Context, argv int, reply *int) error {
+	<-ctx.Done()
+	select {
+	case w.done <- ctx.Err():
+	default:
+	}
+	return ctx.Err()
+}
+
+// Hold 通知测试已经开始处理，等测试放行之后返回 argv。ctx 先结束的话把原因交给测试
+func (w *Waiter) Hold(ctx context.Context, argv int, reply *int) error {
+	w.entered <- struct{}{}
+	select {
+	case <-w.release:
+		*reply = argv
+		return nil
+	case <-ctx.Done():
+		select {
+		case w.done <- ctx.Err():
+		default:
+		}
+		return ctx.Err()
+	}
+}
+
+// Block 不带 ctx 的方法，通知测试已经开始处理，等测试放行之后返回 argv，超时了也停不下来
+func (w *Waiter) Block(argv int, reply *int) error {
+	w.entered <- struct{}{}
+	<-w.release
+	*reply = argv
+	return nil
+}
+
+// Sleep 睡 d 之后返回 1
+func (w *Waiter) Sleep(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	*reply = 1
+	return nil
+}
+
+// Panic 在方法里面 panic
+func (w *Waiter) Panic(argv int, reply *int) error {
+	var m map[string]int
+	m["boom"] = argv
+	return nil
+}
+
+// Deadline 返回 ctx 的截止时间还剩多久，没有截止时间时返回 -1
+func (w *Waiter) Deadline(ctx context.Context, argv int, reply *time.Duration) error {
+	*reply = -1
+	if deadline, ok := ctx.Deadline(); ok {
+		*reply = time.Until(deadline)
+	}
+	return nil
+}
+
+// Peer 返回客户端的地址
+func (w *Waiter) Peer(ctx context.Context, argv int, reply *string) error {
+	p, ok := PeerFromContext(ctx)
+	if !ok {
+		return errors.New("no peer in context")
+	}
+	*reply = p.Addr.String() + " " + string(p.CodecType)
+	return nil
+}
+
+func TestServer_context(t *testing.T) {
+	t.Parallel()
+	w := &Waiter{done: make(chan error, 1), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	s := NewServer()
+	_ = s.Register(w)
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go s.Accept(l)
+	addr := l.Addr().String()
+
+	t.Run("peer", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "dial: %v", err)
+		client, err := NewClient(conn, &Option{MagicNumber: MagicNumber, CodecType: codec.JsonType})
+		_assert(err == nil, "new client: %v", err)
+		defer client.Close()
+		var reply string
+		err = client.Call(context.Background(), "Waiter.Peer", 0, &reply)
+		want := conn.LocalAddr().String() + " " + string(codec.JsonType)
+		_assert(err == nil && reply == want, "unexpected peer: %q, want %q, %v", reply, want, err)
+	})
+	t.Run("deadline", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &Option{HandleTimeout: time.Minute})
+		defer client.Close()
+		var left time.Duration
+		err := client.Call(context.Background(), "Waiter.Deadline", 0, &left)
+		_assert(err == nil && left > 0 && left <= time.Minute, "unexpected deadline: %s, %v", left, err)
+		client2, _ := Dial("tcp", addr)
+		defer client2.Close()
+		err = client2.Call(context.Background(), "Waiter.Deadline", 0, &left)
+		_assert(err == nil && left == -1, "expect no deadline without a handle timeout: %s, %v", left, err)
+	})
+	t.Run("handle timeout", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &Option{HandleTimeout: 100 * time.Millisecond})
+		defer client.Close()
+		err := client.Call(context.Background(), "Waiter.Wait", 0, new(int))
+		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error, got %v", err)
+		select {
+		case err = <-w.done:
+			_assert(err == context.DeadlineExceeded, "unexpected ctx error: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("ctx is not cancelled after the handle timeout")
+		}
+	})
+	t.Run("client deadline", func(t *testing.T) {
+		client, _ := Dial("tcp", addr, &Option{HandleTimeout: time.Minute})
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		var left time.Duration
+		err := client.Call(ctx, "Waiter.Deadline", 0, &left)
+		_assert(err == nil && left > 0 && left <= 100*time.Millisecond, "expect the client deadline: %s, %v", left, err)
+		err = client.Call(ctx, "Waiter.Wait", 0, new(int))
+		_assert(err != nil && strings.Contains(err.Error(), context.DeadlineExceeded.Error()), "expect a timeout error, got %v", err)
+		select {
+		case err = <-w.done:
+			// 客户端到期时也会发取消帧，可能比服务端自己的计时器先到
+			_assert(err == context.DeadlineExceeded || err == context.Canceled, "unexpected ctx error: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("ctx is not cancelled at the client deadline")
+		}
+		_assert(client.IsAvailable(), "client should still be available")
+	})
+	t.Run("client cancel", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		defer client.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		err := client.Call(ctx, "Waiter.Wait", 0, new(int))
+		_assert(err != nil && strings.Contains(err.Error(), context.Canceled.Error()), "expect a cancel error, got %v", err)
+		select {
+		case err = <-w.done:
+			_assert(err == context.Canceled, "unexpected ctx error: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("ctx is not cancelled by the cancel frame")
+		}
+		_assert(client.IsAvailable(), "client should still be available")
+	})
+	t.Run("cancel frame", func(t *testing.T) {
+		// 取消之后服务端不会再发这个请求的响应，读到的第一个响应就是下一个请求的
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		_assert(writeHandshake(conn, &Option{CodecType: codec.TlvType}) == nil && readHandshakeReply(conn) == nil, "handshake")
+		cc := codec.NewTlvCodec(conn)
+		_assert(cc.Write(&codec.Header{ServiceMethod: "Waiter.Wait", Seq: 1}, 0) == nil, "write request")
+		_assert(cc.Write(&codec.Header{Seq: 1, Cancel: true}, invalidRequest) == nil, "write cancel")
+		select {
+		case err := <-w.done:
+			_assert(err == context.Canceled, "unexpected ctx error: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("ctx is not cancelled by the cancel frame")
+		}
+		_assert(cc.Write(&codec.Header{ServiceMethod: "Waiter.Deadline", Seq: 2, Timeout: time.Second}, 0) == nil, "write request")
+		h, left := &codec.Header{}, time.Duration(0)
+		_assert(cc.ReadHeader(h) == nil && h.Seq == 2 && h.Error == "", "unexpected header: %+v", h)
+		_assert(cc.ReadBody(&left) == nil && left > 0 && left <= time.Second, "unexpected deadline: %s", left)
+	})
+	t.Run("duplicate seq", func(t *testing.T) {
+		// Seq 重复的请求被拒绝，取消帧取消的还是第一个请求
+		conn, _ := net.Dial("tcp", addr)
+		defer conn.Close()
+		_assert(writeHandshake(conn, &Option{CodecType: codec.TlvType}) == nil && readHandshakeReply(conn) == nil, "handshake")
+		cc := codec.NewTlvCodec(conn)
+		_assert(cc.Write(&codec.Header{ServiceMethod: "Waiter.Hold", Seq: 5}, 0) == nil, "write request")
+		<-w.entered
+		_assert(cc.Write(&codec.Header{ServiceMethod: "Waiter.Deadline", Seq: 5}, 0) == nil, "write request")
+		h := &codec.Header{}
+		_assert(cc.ReadHeader(h) == nil && h.Seq == 5 && strings.Contains(h.Error, "duplicate seq"), "unexpected header: %+v", h)
+		_assert(cc.ReadBody(nil) == nil, "read body")
+		_assert(cc.Write(&codec.Header{Seq: 5, Cancel: true}, invalidRequest) == nil, "write cancel")
+		select {
+		case err := <-w.done:
+			_assert(err == context.Canceled, "unexpected ctx error: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("the first request is not cancelled by the cancel frame")
+		}
+	})
+	t.Run("disconnect", func(t *testing.T) {
+		// 连接被重置，服务端读出错，还在处理的请求被取消
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "dial: %v", err)
+		_ = conn.(*net.TCPConn).SetLinger(0) // Close 时发 RST
+		client, err := NewClient(conn, &Option{CodecType: codec.TlvType})
+		_assert(err == nil, "new client: %v", err)
+		call := client.Go("Waiter.Hold", 0, new(int), make(chan *Call, 1))
+		<-w.entered
+		_ = client.Close()
+		<-call.Done
+		select {
+		case err := <-w.done:
+			_assert(err == context.Canceled, "unexpected ctx error: %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("ctx is not cancelled after the connection is reset")
+		}
+	})
+	t.Run("half close", func(t *testing.T) {
+		// 客户端发完请求就关闭写的一方，服务端读到 EOF，已经收到的请求照常处理，响应照常发回去
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "dial: %v", err)
+		defer conn.Close()
+		_assert(writeHandshake(conn, &Option{CodecType: codec.TlvType}) == nil && readHandshakeReply(conn) == nil, "handshake")
+		cc := codec.NewTlvCodec(conn)
+		_assert(cc.Write(&codec.Header{ServiceMethod: "Waiter.Hold", Seq: 1}, 7) == nil, "write request")
+		<-w.entered
+		_assert(conn.(*net.TCPConn).CloseWrite() == nil, "close write")
+		// 给服务端一点时间读到 EOF，这段时间里 ctx 不应该被取消
+		select {
+		case err := <-w.done:
+			t.Fatalf("ctx shouldn't be cancelled by EOF: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		w.release <- struct{}{}
+		h, reply := &codec.Header{}, 0
+		_assert(cc.ReadHeader(h) == nil && h.Seq == 1 && h.Error == "", "unexpected header: %+v", h)
+		_assert(cc.ReadBody(&reply) == nil && reply == 7, "unexpected reply: %d", reply)
+	})
+}
+
+func TestServer_interceptors(t *testing.T) {
+	t.Parallel()
+	var (
+		mu    sync.Mutex
+		trace []string
+	)
+	record := func(name string) UnaryServerInterceptor {
+		return func(ctx context.Context, info *UnaryServerInfo, args interface{}, handler UnaryHandler) error {
+			mu.Lock()
+			trace = append(trace, name+" "+info.ServiceMethod)
+			mu.Unlock()
+			return handler(ctx, args)
+		}
+	}
+	traced := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), trace...)
+	}
+	auth := func(ctx context.Context, info *UnaryServerInfo, args interface{}, handler UnaryHandler) error {
+		if info.Metadata["token"] != "secret" {
+			return errors.New("unauthenticated")
+		}
+		return handler(ctx, args)
+	}
+	// 把参数换成它的相反数，返回之后再检查结果
+	negate := func(ctx context.Context, info *UnaryServerInfo, args interface{}, handler UnaryHandler) error {
+		if err := handler(ctx, -args.(int)); err != nil {
+			return err
+		}
+		if *info.Reply.(*int) > 0 {
+			return errors.New("reply should be negative")
+		}
+		return nil
+	}
+	s := NewServer(WithInterceptors(record("first"), auth), WithInterceptors(record("second"), negate))
+	_ = s.Register(new(Bar))
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go s.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial: %v", err)
+	defer client.Close()
+
+	reply := new(int)
+	err = client.Call(context.Background(), "Bar.Double", 2, reply)
+	_assert(err != nil && strings.Contains(err.Error(), "unauthenticated"), "expect the call to be rejected, got %v", err)
+	got := traced()
+	_assert(len(got) == 1 && got[0] == "first Bar.Double", "unexpected trace: %v", got)
+
+	ctx := WithMetadata(context.Background(), map[string]string{"token": "secret"})
+	err = client.Call(ctx, "Bar.Double", 2, reply)
+	_assert(err == nil && *reply == -4, "unexpected reply: %d, %v", *reply, err)
+	got = traced()
+	_assert(len(got) == 3 && got[2] == "second Bar.Double", "unexpected trace: %v", got)
+	_assert(client.IsAvailable(), "client should still be available")
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+	w := &Waiter{done: make(chan error, 1), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	s := NewServer()
+	_ = s.Register(w)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	addr := l.Addr().String()
+	hooked := make(chan struct{})
+	s.RegisterOnShutdown(func(ctx context.Context) { close(hooked) })
+
+	busy, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	idle, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	call := busy.Go("Waiter.Block", 1, new(int), nil)
+	<-w.entered
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	<-hooked
+	// 收到 GOAWAY 之后客户端不再可用，新的调用直接失败，已经发出的调用照常完成
+	_assert(eventually(func() bool { return !busy.IsAvailable() }), "busy client should receive the goaway")
+	_assert(busy.IsDraining(), "busy client should be draining")
+	err = busy.Call(context.Background(), "Waiter.Deadline", 0, new(time.Duration))
+	_assert(err == ErrShutdown, "expect ErrShutdown for a new call, got %v", err)
+	select {
+	case err = <-shutdown:
+		t.Fatalf("shutdown should wait for in-flight calls: %v", err)
+	default:
+	}
+	w.release <- struct{}{}
+	call = <-call.Done
+	_assert(call.Error == nil && *call.Reply.(*int) == 1, "in-flight call should succeed: %v", call.Error)
+	_assert(<-shutdown == nil, "shutdown")
+	// 服务端关闭连接之后，客户端读到 EOF 才算关闭
+	_assert(eventually(func() bool { return !idle.IsAvailable() && !busy.IsDraining() }), "clients should be closed")
+	_, err = Dial("tcp", addr, &Option{ConnectTimeout: time.Second})
+	_assert(err != nil, "expect the listener to be closed")
+	// Shutdown 之后 Accept 直接返回
+	l2, _ := net.Listen("tcp", ":0")
+	s.Accept(l2)
+	_, err = net.Dial("tcp", l2.Addr().String())
+	_assert(err != nil, "expect the listener to be closed")
+}
+
+func TestServer_Shutdown_draining(t *testing.T) {
+	t.Parallel()
+	w := &Waiter{done: make(chan error, 1), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	s := NewServer()
+	_ = s.Register(w)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+
+	// 不理会 GOAWAY 的客户端接着发请求，服务端直接回错误，手上的请求照常处理完再关闭连接
+	conn, err := net.Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial: %v", err)
+	defer conn.Close()
+	_assert(writeHandshake(conn, &Option{CodecType: codec.TlvType}) == nil && readHandshakeReply(conn) == nil, "handshake")
+	cc := codec.NewTlvCodec(conn)
+	_assert(cc.Write(&codec.Header{ServiceMethod: "Waiter.Hold", Seq: 1}, 3) == nil, "write request")
+	<-w.entered
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	h := &codec.Header{}
+	_assert(cc.ReadHeader(h) == nil && h.GoAway && cc.ReadBody(nil) == nil, "expect a goaway frame: %+v", h)
+	_assert(cc.Write(&codec.Header{ServiceMethod: "Waiter.Deadline", Seq: 2}, 0) == nil, "write request")
+	h = &codec.Header{}
+	_assert(cc.ReadHeader(h) == nil && h.Seq == 2 && h.Error == errShuttingDown, "unexpected header: %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "read body")
+	w.release <- struct{}{}
+	h, reply := &codec.Header{}, 0
+	_assert(cc.ReadHeader(h) == nil && h.Seq == 1 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "unexpected reply: %d", reply)
+	_assert(<-shutdown == nil, "shutdown")
+	_assert(cc.ReadHeader(h) != nil, "expect the server to close the connection")
+}
+
+// TestServerConn_tryBegin 已经收下的请求不会被 GOAWAY 连同连接一起关掉，GOAWAY 之后的请求会被拒绝
+func TestServerConn_tryBegin(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+	closed := func() bool { return conn.SetReadDeadline(time.Time{}) != nil }
+	sc := &serverConn{conn: conn, sending: new(sync.Mutex)}
+	_assert(sc.setCodec(codec.NewTlvCodec(conn)), "set codec")
+	_assert(sc.tryBegin(), "expect the request to be accepted before goaway")
+	sc.goAway()
+	_assert(!closed(), "the connection shouldn't be closed while a request is being handled")
+	_assert(!sc.tryBegin(), "expect the request to be rejected after goaway")
+	sc.end()
+	_assert(closed(), "expect the connection to be closed after the last request")
+}
+
+func TestServer_Shutdown_timeout(t *testing.T) {
+	t.Parallel()
+	w := &Waiter{done: make(chan error, 1), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	s := NewServer()
+	_ = s.Register(w)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial: %v", err)
+	call := client.Go("Waiter.Hold", 0, new(int), nil)
+	<-w.entered
+	// 注册中心一直不响应，也不能让 Shutdown 超过 ctx 的截止时间
+	stuck := make(chan struct{})
+	defer close(stuck)
+	s.RegisterOnShutdown(func(ctx context.Context) { <-stuck })
+
+	// 方法一直不返回，ctx 结束时强制关闭连接，方法收到取消
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	_assert(err == context.DeadlineExceeded, "expect a timeout error, got %v", err)
+	select {
+	case err = <-w.done:
+		_assert(err == context.Canceled, "unexpected ctx error: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("ctx is not cancelled after the connection is closed")
+	}
+	call = <-call.Done
+	_assert(call.Error != nil, "expect the call to fail")
+}
+
+func TestServer_panic(t *testing.T) {
+	t.Parallel()
+	for _, debug := range []bool{false, true} {
+		hooked := make(chan *PanicInfo, 1)
+		opts := []ServerOption{WithPanicHook(func(ctx context.Context, info *PanicInfo) {
+			_, ok := PeerFromContext(ctx)
+			_assert(ok, "hook should get the request context")
+			hooked <- info
+		})}
+		if debug {
+			opts = append(opts, WithDebug())
+		}
+		s := NewServer(opts...)
+		_ = s.Register(&Waiter{})
+		l, _ := net.Listen("tcp", ":0")
+		go s.Accept(l)
+		client, err := Dial("tcp", l.Addr().String())
+		_assert(err == nil, "dial: %v", err)
+
+		// panic 变成这个请求的错误，连接和服务端都还能继续用
+		err = client.Call(context.Background(), "Waiter.Panic", 1, new(int))
+		_assert(err != nil && strings.Contains(err.Error(), "panic serving Waiter.Panic: assignment to entry in nil map"), "unexpected error: %v", err)
+		_assert(strings.Contains(err.Error(), "goroutine ") == debug, "stack should be included only in debug mode: %v", err)
+		info := <-hooked
+		_assert(info.ServiceMethod == "Waiter.Panic" && strings.Contains(string(info.Stack), "(*Waiter).Panic"), "unexpected panic info: %+v", info)
+		var reply int
+		err = client.Call(context.Background(), "Waiter.Sleep", time.Duration(0), &reply)
+		_assert(err == nil && reply == 1 && client.IsAvailable(), "client should still work: %v", err)
+		svc, mtype, _ := s.findService("Waiter.Panic")
+		_assert(svc != nil && mtype.NumPanics() == 1 && mtype.NumCalls() == 1, "unexpected stats: %d panics", mtype.NumPanics())
+		_ = client.Close()
+		_ = s.Shutdown(context.Background())
+	}
+}
+
+func TestServer_methodTimeout(t *testing.T) {
+	t.Parallel()
+	w := &Waiter{done: make(chan error, 1), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	s := NewServer(WithMethodTimeout("Waiter.Wait", 100*time.Millisecond), WithMethodTimeout("Waiter.Block", 10*time.Millisecond))
+	_ = s.Register(w)
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go s.Accept(l)
+	addr := l.Addr().String()
+
+	for _, c := range []struct {
+		handleTimeout time.Duration
+		expect        string
+	}{
+		{0, "expect within 100ms"},                    // 客户端没有设置，用服务端给方法设置的
+		{50 * time.Millisecond, "expect within 50ms"}, // 取较短的那个
+		{time.Minute, "expect within 100ms"},
+	} {
+		client, _ := Dial("tcp", addr, &Option{HandleTimeout: c.handleTimeout})
+		err := client.Call(context.Background(), "Waiter.Wait", 0, new(int))
+		_assert(err != nil && strings.Contains(err.Error(), c.expect), "expect %q, got %v", c.expect, err)
+		err = <-w.done
+		_assert(err == context.DeadlineExceeded, "unexpected ctx error: %v", err)
+		// 其他方法不受影响
+		var left time.Duration
+		err = client.Call(context.Background(), "Waiter.Deadline", 0, &left)
+		_assert(err == nil && (c.handleTimeout == 0) == (left == -1), "unexpected deadline: %s, %v", left, err)
+		_ = client.Close()
+	}
+
+	// 不带 ctx 的方法超时之后还在跑，Shutdown 要等它真正返回
+	client, _ := Dial("tcp", addr)
+	defer client.Close()
+	err := client.Call(context.Background(), "Waiter.Block", 1, new(int))
+	_assert(err != nil && strings.Contains(err.Error(), "expect within 10ms"), "expect a timeout error, got %v", err)
+	<-w.entered
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	_assert(eventually(func() bool { return !client.IsAvailable() }), "client should receive the goaway")
+	select {
+	case err = <-shutdown:
+		t.Fatalf("shutdown returned while the method is still running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.release <- struct{}{}
+	_assert(<-shutdown == nil, "shutdown")
+}
+
+// TestWaitDone 方法已经返回了的话，即使 ctx 也结束了，还是用方法的结果
+func TestWaitDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan error, 1)
+	finished, _ := waitDone(ctx, done)
+	_assert(!finished, "expect the method to be unfinished")
+	for i := 0; i < 100; i++ {
+		done <- errors.New("method error")
+		finished, err := waitDone(ctx, done)
+		_assert(finished && err != nil && err.Error() == "method error", "expect the result of the method, got %v, %v", finished, err)
+	}
+}
+
+// eventually 反复检查 cond，直到它成立或者过了 5 秒
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// TestServer_goroutineLeak 大量请求超时、被取消、panic 之后，服务端和客户端的协程都能退出。
+// 不能和其他测试并行，否则协程数会互相影响
+func TestServer_goroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	s := NewServer(WithMethodTimeout("Waiter.Sleep", 20*time.Millisecond))
+	_ = s.Register(&Waiter{})
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.TlvType, HandleTimeout: 30 * time.Millisecond})
+		_assert(err == nil, "dial: %v", err)
+		defer client.Close()
+		for j := 0; j < 50; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(j%5)*10*time.Millisecond+5*time.Millisecond)
+				defer cancel()
+				switch j % 4 {
+				case 0: // 带 context 的方法，超时之后马上退出
+					_ = client.Call(context.Background(), "Waiter.Wait", 0, new(int))
+				case 1: // 不带 context 的方法，超时之后还要再跑一会儿
+					_ = client.Call(context.Background(), "Waiter.Sleep", 50*time.Millisecond, new(int))
+				case 2: // 客户端先超时，发取消帧
+					_ = client.Call(ctx, "Waiter.Wait", 0, new(int))
+				case 3:
+					_ = client.Call(context.Background(), "Waiter.Panic", 0, new(int))
+				}
+			}(j)
+		}
+	}
+	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_assert(s.Shutdown(ctx) == nil, "shutdown")
+
+	// Shutdown 已经等到超时的方法都返回了，客户端的接收协程读到连接关闭之后也会退出
+	after := runtime.NumGoroutine()
+	if !eventually(func() bool { after = runtime.NumGoroutine(); return after <= before }) {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("goroutines leaked: %d before, %d after\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
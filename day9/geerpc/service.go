@@ -1,6 +1,7 @@
 package geerpc
 
 import (
+	"context"
 	"go/ast"
 	"log"
 	"reflect"
@@ -52,6 +53,8 @@ type methodType struct {
 	ArgType   reflect.Type   // 第一个参数（入参）类型
 	ReplyType reflect.Type   // 第二个参数（返回值）类型
 	numCalls  uint64         // 统计这个方法调用的次数
+	numPanics uint64         // 统计这个方法 panic 的次数
+	withCtx   bool           // 方法的第一个参数是不是 context.Context
 }
 
 // 因为 methodType 里面 ArgType、ReplyType 都是 reflect.Type 类型，所以我们给 methodType 添加两个方法，让这两个字段能变成类型的值
@@ -85,6 +88,16 @@ func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+// NumPanics 这个方法 panic 的次数
+func (m *methodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
+// WithContext 方法的第一个参数是不是 context.Context，debug 页面展示方法签名时用
+func (m *methodType) WithContext() bool {
+	return m.withCtx
+}
+
 // 接着给 service 添加构造方法，将结构体映射为服务
 func newService(rcvr interface{}) *service {
 	s := &service{}
@@ -98,19 +111,27 @@ func newService(rcvr interface{}) *service {
 	return s
 }
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 func (s *service) registerMethods() {
 	// func (s *service) methodName(argv, replyv) error {}
+	// 或者 func (s *service) methodName(ctx context.Context, argv, replyv) error {}，
+	// ctx 中可以拿到请求的元数据、客户端的信息（PeerFromContext）和处理的截止时间，处理超时或者连接出错时 ctx 会被取消
 	s.methods = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		mt := method.Type
-		if mt.NumIn() != 3 || mt.NumOut() != 1 { // 入参加接收器 3 个，返回值 1 个
+		if mt.NumOut() != 1 || mt.Out(0) != typeOfError { // 返回值 1 个，类型是 error
 			continue
 		}
-		if mt.Out(0) != reflect.TypeOf((*error)(nil)).Elem() { // 返回值类型
+		withCtx := mt.NumIn() == 4 && mt.In(1) == typeOfContext
+		if mt.NumIn() != 3 && !withCtx { // 入参加接收器 3 个，带 context 的话 4 个
 			continue
 		}
-		argType, replyType := mt.In(1), mt.In(2)
+		argType, replyType := mt.In(mt.NumIn()-2), mt.In(mt.NumIn()-1)
 		if !isExportedOrBuiltin(argType) || !isExportedOrBuiltin(replyType) {
 			continue
 		}
@@ -119,6 +140,7 @@ func (s *service) registerMethods() {
 			ArgType:   argType,
 			ReplyType: replyType,
 			numCalls:  0,
+			withCtx:   withCtx,
 		}
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
@@ -130,10 +152,14 @@ func isExportedOrBuiltin(typ reflect.Type) bool {
 
 // 接着写一个 service 调用注册进服务的方法
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	rtval := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.withCtx {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	rtval := f.Call(in)
 	if errInter := rtval[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -0,0 +1,199 @@
+package geerpc
+
+import (
+	"context"
+	"geerpc/codec"
+	"log"
+	"net"
+	"sync"
+)
+
+// 优雅关闭：Shutdown 先关掉所有的 listener 不再接收新的连接，执行 RegisterOnShutdown 注册的函数（比如从注册中心注销），
+// 再给每个连接发一个 GOAWAY 帧，客户端收到之后不再在这个连接上发新的请求（之后还收到的请求直接回错误），已经发出的请求照常处理并响应，
+// 一个连接上的请求都处理完了就关闭这个连接，所有连接都关闭之后 Shutdown 返回
+
+// serverConn 服务端的一个连接，Shutdown 时要通知客户端、等它处理完手上的请求
+type serverConn struct {
+	conn    net.Conn
+	sending *sync.Mutex // 与 serveCodec 中写响应用的是同一把锁，GOAWAY 不会插到一个响应的中间
+	cancel  func()      // 取消这个连接上所有请求的 ctx，连接读写出错时调用
+
+	mu       sync.Mutex
+	cc       codec.Codec // 握手完成之前为 nil
+	active   int         // 正在处理的请求数
+	draining bool        // 已经发过 GOAWAY 了，手上的请求处理完就关闭
+}
+
+// setCodec 握手完成了。已经开始关闭的话返回 false，这个连接不用再处理了
+func (sc *serverConn) setCodec(cc codec.Codec) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.cc = cc
+	return !sc.draining
+}
+
+// errShuttingDown 发过 GOAWAY 之后收到的请求的错误信息
+const errShuttingDown = "rpc server: server is shutting down"
+
+// tryBegin 开始处理一个请求，已经发过 GOAWAY 的话返回 false。
+// 检查和计数在同一把锁里，goAway 不会在两者之间看到 active == 0，把已经收下的请求连同连接一起关掉
+func (sc *serverConn) tryBegin() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.draining {
+		return false
+	}
+	sc.active++
+	return true
+}
+
+// begin 开始处理一个请求
+func (sc *serverConn) begin() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.active++
+}
+
+// end 一个请求处理完了，正在关闭而且没有别的请求了的话就关闭连接
+func (sc *serverConn) end() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.active--
+	if sc.draining && sc.active == 0 {
+		_ = sc.conn.Close()
+	}
+}
+
+// goAway 告诉客户端服务端要关闭了，没有正在处理的请求的话直接关闭连接
+func (sc *serverConn) goAway() {
+	sc.mu.Lock()
+	if sc.draining {
+		sc.mu.Unlock()
+		return
+	}
+	sc.draining = true
+	cc := sc.cc
+	sc.mu.Unlock()
+	if cc == nil { // 还在握手，没法发 GOAWAY，直接关闭
+		_ = sc.conn.Close()
+		return
+	}
+	sc.sending.Lock()
+	err := cc.Write(&codec.Header{GoAway: true}, invalidRequest)
+	sc.sending.Unlock()
+	if err != nil {
+		log.Println("rpc server: send goaway fail: ", err)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if err != nil || sc.active == 0 {
+		_ = sc.conn.Close()
+	}
+}
+
+// trackListener 记录正在 Accept 的 listener，Shutdown 时关闭。已经开始关闭的话返回 false
+func (s *Server) trackListener(lis net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, lis)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn 记录正在服务的连接。已经开始关闭的话返回 false
+func (s *Server) trackConn(sc *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, sc)
+		s.connWg.Done()
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	s.conns[sc] = struct{}{}
+	s.connWg.Add(1)
+	return true
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// RegisterOnShutdown 注册一个 Shutdown 时调用的函数，比如从注册中心注销这个服务器。
+// 这些函数在发送 GOAWAY 之前各自在一个协程里并发调用，ctx 就是传给 Shutdown 的 ctx，发网络请求之类可能卡住的操作要用它控制时间
+func (s *Server) RegisterOnShutdown(f func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Shutdown 优雅地关闭 Server：不再接收新的连接和请求，等已经收到的请求都处理完、连接都关闭之后返回 nil。
+// ctx 先结束的话直接关闭剩下的连接，返回 ctx.Err()，这时还在执行的服务方法会收到 ctx 的取消。
+// Shutdown 之后再调用 Accept 会直接关闭 listener 返回
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	hooks := s.onShutdown
+	s.onShutdown = nil
+	for lis := range s.listeners {
+		_ = lis.Close()
+	}
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+
+	// 先从注册中心注销，新的调用就不会再选到这个服务器了。注销要访问注册中心，可能一直卡着，所以最多等到 ctx 结束
+	var hookWg sync.WaitGroup
+	for _, f := range hooks {
+		hookWg.Add(1)
+		go func(f func(ctx context.Context)) {
+			defer hookWg.Done()
+			f(ctx)
+		}(f)
+	}
+	if err := s.wait(ctx, &hookWg); err != nil {
+		return err
+	}
+	for _, sc := range conns {
+		sc.goAway()
+	}
+	return s.wait(ctx, &s.connWg)
+}
+
+// wait 等 wg 结束，ctx 先结束的话直接关闭剩下的连接，返回 ctx.Err()
+func (s *Server) wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for sc := range s.conns {
+			_ = sc.conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -148,7 +148,7 @@ func (m *MultiServersDiscovery) Get(mode SelectMode, serviceMethod ...string) (s
 		return s, nil
 	case ConsistentHash:
 		if len(serviceMethod) != 1 {
-			return "", fmt.Errorf("rpc discovery: %s mode only need one args: %s", mode, serviceMethod)
+			return "", fmt.Errorf("rpc discovery: %d mode only need one args: %s", mode, serviceMethod)
 		}
 		m.hmap.Add(m.servers...)
 		return m.hmap.Get(serviceMethod[0]), nil
@@ -17,6 +17,8 @@ type XClient struct {
 	mu      sync.Mutex         // 需要一个锁
 	clients map[string]*Client // 一个通用客户端的集合，主要是为了资源复用。[rpcAddr -> *Client]
 	opt     *Option            // 既然 XClient 是面向用户的接口，那么也得给给用户可定制的操作
+
+	interceptors []UnaryClientInterceptor // opt 中的拦截器，由 XClient 在选好服务器之后调用
 }
 
 // 因为是客户端，所以需要实现 io.Closer 接口
@@ -34,15 +36,22 @@ func (xc *XClient) Close() error {
 	return nil
 }
 
-// NewXClient 接着来一个构造方法
+// NewXClient 接着来一个构造方法。opt 中的拦截器包在每次对选中的服务器的调用外面，拦截器看到的地址是 rpcAddr
 func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{
+	xc := &XClient{
 		mode:    mode,
 		d:       d,
 		mu:      sync.Mutex{},
 		clients: map[string]*Client{},
 		opt:     opt,
 	}
+	if opt != nil && len(opt.Interceptors) > 0 {
+		// 底层的 Client 就不用再调用一遍拦截器了
+		dialOpt := *opt
+		dialOpt.Interceptors = nil
+		xc.opt, xc.interceptors = &dialOpt, opt.Interceptors
+	}
+	return xc
 }
 
 // 既然是客户端，那必然要有 dial方法连接服务端
@@ -52,7 +61,9 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	defer xc.mu.Unlock()
 	client, ok := xc.clients[rpcAddr]
 	if ok && !client.IsAvailable() { // 这个客户端存在但是不可用，那么移除它
-		_ = client.Close()
+		if !client.IsDraining() { // 收到 GOAWAY 的客户端还在等已经发出的调用的响应，服务端处理完之后它会自己关闭
+			_ = client.Close()
+		}
 		delete(xc.clients, rpcAddr)
 		client = nil
 	}
@@ -69,12 +80,15 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 
 // 方法签名与 Client 类似，因为底层就是用的 Client
 func (xc *XClient) call(ctx context.Context, rpcAddr string, serviceMethod string, args, reply interface{}) error {
-	// 通过服务器地址，拿到与该 Server 对应的 Client
-	client, err := xc.dial(rpcAddr)
-	if err != nil {
-		return err
-	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	invoker := ChainUnaryClient(xc.interceptors, rpcAddr, func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+		// 通过服务器地址，拿到与该 Server 对应的 Client
+		client, err := xc.dial(rpcAddr)
+		if err != nil {
+			return err
+		}
+		return client.Call(ctx, serviceMethod, args, reply)
+	})
+	return invoker(ctx, serviceMethod, args, reply)
 }
 
 // Call 为 call 方法封装上负载均衡策略，并对外暴露
@@ -118,6 +132,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	var er error
 	replyDone := reply == nil // reply 为 nil 或者 reply 已经被赋过一次值，都不需要再赋值
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
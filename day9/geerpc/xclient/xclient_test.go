@@ -0,0 +1,74 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	. "geerpc"
+	"net"
+	"sync"
+	"testing"
+)
+
+type Foo int
+
+func (f Foo) Sum(argv [2]int, reply *int) error {
+	*reply = argv[0] + argv[1]
+	return nil
+}
+
+func startServer(t *testing.T) string {
+	s := NewServer()
+	_ = s.Register(new(Foo))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	return "tcp@" + l.Addr().String()
+}
+
+func TestXClient_interceptors(t *testing.T) {
+	servers := []string{startServer(t), startServer(t)}
+	var (
+		mu    sync.Mutex
+		addrs = make(map[string]int)
+		calls int
+	)
+	// 记下每次调用选中的服务器，底层 Client 不会再调用一遍拦截器
+	record := func(ctx context.Context, info *UnaryClientInfo, args, reply interface{}, invoker UnaryInvoker) error {
+		mu.Lock()
+		addrs[info.Addr]++
+		calls++
+		mu.Unlock()
+		return invoker(ctx, info.ServiceMethod, args, reply)
+	}
+	reject := func(ctx context.Context, info *UnaryClientInfo, args, reply interface{}, invoker UnaryInvoker) error {
+		if info.ServiceMethod != "Foo.Sum" {
+			return errors.New("rejected")
+		}
+		return invoker(ctx, info.ServiceMethod, args, reply)
+	}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, &Option{Interceptors: []UnaryClientInterceptor{record, reject}})
+	defer xc.Close()
+
+	for i := 0; i < 4; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", [2]int{i, i}, &reply); err != nil || reply != 2*i {
+			t.Fatalf("unexpected reply: %d, %v", reply, err)
+		}
+	}
+	if err := xc.Call(context.Background(), "Foo.Other", [2]int{}, new(int)); err == nil || err.Error() != "rejected" {
+		t.Fatalf("expect the call to be rejected, got %v", err)
+	}
+	var reply int
+	if err := xc.Broadcast(context.Background(), "Foo.Sum", [2]int{1, 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("unexpected broadcast reply: %d, %v", reply, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// 轮询的 4 次各占一半，被拒绝的 1 次，广播的 2 次
+	if calls != 7 || addrs[servers[0]] < 3 || addrs[servers[1]] < 3 {
+		t.Fatalf("unexpected calls: %d, %v", calls, addrs)
+	}
+}
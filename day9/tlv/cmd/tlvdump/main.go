@@ -0,0 +1,281 @@
+// tlvdump 不需要 Go 结构体，直接把 TLV 字节按树形打印出来，用来排查线上抓到的包。
+//
+// 用法：
+//
+//	tlvdump [-hex] [-geerpc] [文件 ...]   不指定文件或者文件是 - 时读标准输入
+//	tlvdump -listen :9999 [-geerpc]       监听一个地址，把连上来的客户端发送的内容打印出来
+//
+// -listen 加上 -geerpc 时会像 geerpc 服务端一样应答握手，客户端才会接着发送请求，但请求不会有响应，
+// 客户端要设置超时或者自己关闭连接，tlvdump 读到连接关闭之后打印。
+// 不方便让客户端连到 tlvdump 的话，也可以用 tcpdump 抓包，把 TCP 的内容保存到文件里再交给 tlvdump：
+//
+//	tcpdump -i lo -w rpc.pcap 'tcp port 9999'   然后在 Wireshark 中用 Follow TCP Stream 导出客户端发送的原始数据
+//
+// -hex 表示输入是十六进制文本（比如从 Wireshark 复制出来的），空白字符会被忽略；
+// -geerpc 表示输入是一条 geerpc 连接抓到的数据：开头是握手的 Option（二进制的，或者老版本 JSON 编码的），后面是成对的 Header 和 Body（开启了分帧的话带着长度）
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"tlv/codec"
+	"tlv/wire"
+)
+
+var (
+	hexInput = flag.Bool("hex", false, "输入是十六进制文本")
+	geerpc   = flag.Bool("geerpc", false, "输入是 geerpc 连接抓到的数据，开头是握手的 Option")
+	listen   = flag.String("listen", "", "监听的地址，打印连上来的客户端发送的内容")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("tlvdump: ")
+	flag.Parse()
+
+	if *listen != "" {
+		if err := serve(*listen); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	names := flag.Args()
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+	failed := false
+	for _, name := range names {
+		if len(names) > 1 {
+			fmt.Printf("==> %s <==\n", name)
+		}
+		if err := dumpFile(name); err != nil {
+			log.Printf("%s: %v", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func dumpFile(name string) error {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return err
+	}
+	return dump(os.Stdout, data)
+}
+
+// serve 接受一个连接，一直读到对端关闭，再把读到的内容打印出来。
+// 指定了 -geerpc 的话先应答客户端的握手，否则 geerpc 的客户端会一直等待应答，不会发送请求
+func serve(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	log.Printf("监听 %s", lis.Addr())
+	conn, err := lis.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var data bytes.Buffer
+	r := io.TeeReader(conn, &data) // 握手也要打印出来，读到的内容都记下来
+	if *geerpc {
+		if err = acceptHandshake(conn, r); err != nil {
+			return fmt.Errorf("应答握手失败：%w", err)
+		}
+	}
+	if _, err = ioutil.ReadAll(r); err != nil {
+		return err
+	}
+	return dump(os.Stdout, data.Bytes())
+}
+
+// acceptHandshake 读出客户端的握手并应答成功，与 geerpc/handshake.go 中的 readOption 和 writeOptionReply 一致
+func acceptHandshake(w io.Writer, r io.Reader) error {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return err
+	}
+	if first[0] == '{' {
+		// 老版本的客户端：服务端把 Option 原样用 JSON 编码发回去
+		var opt map[string]interface{}
+		if err := json.NewDecoder(io.MultiReader(bytes.NewReader(first), r)).Decode(&opt); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(opt)
+	}
+	header := make([]byte, wire.HeaderSize)
+	header[0] = first[0]
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return err
+	}
+	if magic := binary.BigEndian.Uint32(header); magic != wire.Magic {
+		return fmt.Errorf("魔数 %x 不对", magic)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(binary.BigEndian.Uint16(header[5:]))); err != nil {
+		return err
+	}
+	reply := make([]byte, wire.HeaderSize+1)
+	binary.BigEndian.PutUint32(reply, wire.Magic)
+	reply[4] = wire.Version
+	binary.BigEndian.PutUint16(reply[5:], 1)
+	reply[wire.HeaderSize] = wire.StatusOK
+	_, err := w.Write(reply)
+	return err
+}
+
+func dump(w io.Writer, data []byte) error {
+	if *hexInput {
+		var err error
+		if data, err = decodeHex(data); err != nil {
+			return err
+		}
+	}
+	if !*geerpc {
+		return codec.Dump(w, data)
+	}
+	return dumpConn(w, data)
+}
+
+// dumpConn 打印 geerpc 连接上的数据：| Option | Header1 | Body1 | Header2 | Body2 | ...
+// 开启了分帧的话，每一对 Header 和 Body 前面还有它们的长度
+func dumpConn(w io.Writer, data []byte) error {
+	var offset int
+	var framed bool
+	var err error
+	if len(data) > 0 && data[0] == '{' {
+		offset, framed, err = dumpJsonOption(w, data)
+	} else {
+		offset, framed, err = dumpOption(w, data)
+	}
+	if err != nil {
+		return fmt.Errorf("解析 Option 失败：%w", err)
+	}
+	if framed {
+		return dumpFramed(w, data, offset)
+	}
+	for i := 0; offset < len(data); i++ {
+		label := fmt.Sprintf("[%d] header", i/2)
+		if i%2 == 1 {
+			label = fmt.Sprintf("[%d] body", i/2)
+		}
+		n, err := codec.DumpFrame(w, data[offset:], label)
+		if err != nil {
+			return fmt.Errorf("偏移 %d：%w", offset, err)
+		}
+		offset += n
+	}
+	return nil
+}
+
+// dumpFramed 打印分帧的消息：| Header 长度 | Body 长度 | Header | Body |
+func dumpFramed(w io.Writer, data []byte, offset int) error {
+	for i := 0; offset < len(data); i++ {
+		var lengths [2]uint64
+		for j := range lengths {
+			v, n := binary.Uvarint(data[offset:])
+			if n <= 0 {
+				return fmt.Errorf("偏移 %d：消息长度格式错误", offset)
+			}
+			lengths[j], offset = v, offset+n
+		}
+		fmt.Fprintf(w, "[%d] message header=%d body=%d\n", i, lengths[0], lengths[1])
+		for j, name := range []string{"header", "body"} {
+			if uint64(len(data)-offset) < lengths[j] {
+				return fmt.Errorf("偏移 %d：%w", offset, io.ErrUnexpectedEOF)
+			}
+			end := offset + int(lengths[j])
+			for offset < end {
+				n, err := codec.DumpFrame(w, data[offset:end], fmt.Sprintf("[%d] %s", i, name))
+				if err != nil {
+					return fmt.Errorf("偏移 %d：%w", offset, err)
+				}
+				offset += n
+			}
+		}
+	}
+	return nil
+}
+
+// dumpJsonOption 老版本的 geerpc 用 JSON 编码 Option，返回 Option 占用的字节数，以及是否开启了分帧
+func dumpJsonOption(w io.Writer, data []byte) (int, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var opt map[string]interface{}
+	if err := dec.Decode(&opt); err != nil {
+		return 0, false, err
+	}
+	optJson, _ := json.Marshal(opt)
+	fmt.Fprintf(w, "option %s\n", optJson)
+	offset := int(dec.InputOffset())
+	for offset < len(data) && (data[offset] == '\n' || data[offset] == '\r' || data[offset] == ' ') { // json.Encoder 会在末尾加一个换行
+		offset++
+	}
+	return offset, opt["Framing"] == true, nil
+}
+
+// dumpOption 打印二进制的握手，返回它占用的字节数，以及是否开启了分帧
+func dumpOption(w io.Writer, data []byte) (int, bool, error) {
+	if len(data) < wire.HeaderSize {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+	if magic := binary.BigEndian.Uint32(data); magic != wire.Magic {
+		return 0, false, fmt.Errorf("魔数 %x 不对", magic)
+	}
+	size := wire.HeaderSize + int(binary.BigEndian.Uint16(data[5:]))
+	if len(data) < size || size < wire.HeaderSize+wire.OptionSize {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+	payload := data[wire.HeaderSize:size]
+	name := payload[wire.OptionSize:]
+	if n := int(payload[23]); n <= len(name) {
+		name = name[:n]
+	}
+	fmt.Fprintf(w, "option version=%d codec=%d%s compression=%d flags=%#x connect=%s handle=%s threshold=%d\n",
+		data[4], payload[0], prefixName(name), payload[1], payload[2],
+		time.Duration(binary.BigEndian.Uint64(payload[3:])), time.Duration(binary.BigEndian.Uint64(payload[11:])),
+		binary.BigEndian.Uint32(payload[19:]))
+	if payload[0] != wire.CodecTlv && string(name) != wire.TlvType {
+		return 0, false, errors.New("这条连接用的不是 TLV 编码")
+	}
+	if payload[1] != 0 {
+		return 0, false, errors.New("这条连接开启了压缩，不能直接打印")
+	}
+	return size, payload[2]&wire.FlagFraming != 0, nil
+}
+
+func prefixName(name []byte) string {
+	if len(name) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("(%s)", name)
+}
+
+func decodeHex(data []byte) ([]byte, error) {
+	text := strings.Join(strings.Fields(string(data)), "")
+	text = strings.TrimPrefix(text, "0x")
+	if text == "" {
+		return nil, errors.New("输入为空")
+	}
+	return hex.DecodeString(text)
+}
@@ -0,0 +1,167 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+	"tlv/core"
+)
+
+type quickInner struct {
+	A int8
+	B string
+	C []uint16
+}
+
+// quickArgs 覆盖了 testing/quick 能随机生成的各种类型
+type quickArgs struct {
+	Bool       bool
+	Int        int
+	Int16      int16
+	Int64      int64
+	Uint       uint
+	Uint32     uint32
+	Uint64     uint64
+	Float32    float32
+	Float64    float64
+	Complex128 complex128
+	String     string
+	Bytes      []byte
+	Array      [3]int32
+	ByteArray  [4]byte
+	Slice      []string
+	Map        map[string]int
+	IntMap     map[int64]quickInner
+	Ptr        *quickInner
+	PtrPtr     **int
+	Inner      quickInner
+	Inners     []*quickInner
+	Nested     [][]float64
+	Ignored    int `tlv:"-"`
+}
+
+func encodeObj(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := NewEncoder(io.Discard).EncodeObj(v)
+	if err != nil {
+		t.Fatalf("encode %T: %v", v, err)
+	}
+	return data
+}
+
+func TestRoundTrip_quick(t *testing.T) {
+	f := func(in quickArgs) bool {
+		in.Ignored = 0
+		var out quickArgs
+		if err := NewDecoder(bytes.NewReader(encodeObj(t, &in))).Decode(&out); err != nil {
+			t.Logf("decode: %v", err)
+			return false
+		}
+		return reflect.DeepEqual(in, out)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// randomAny 随机生成一个可以放进 interface{} 的值，类型都是解码时的默认类型，这样解码回来可以直接比较
+func randomAny(r *rand.Rand, depth int) interface{} {
+	n := 9
+	if depth <= 0 { // 不再生成容器
+		n = 7
+	}
+	switch r.Intn(n) {
+	case 0:
+		return nil
+	case 1:
+		return r.Intn(2) == 1
+	case 2:
+		return r.Int63() - r.Int63()
+	case 3:
+		return r.Uint64()
+	case 4:
+		return r.NormFloat64()
+	case 5:
+		v, _ := quick.Value(reflect.TypeOf(""), r)
+		return v.Interface()
+	case 6:
+		b := make([]byte, r.Intn(8))
+		r.Read(b)
+		return b
+	case 7:
+		s := make([]interface{}, r.Intn(5))
+		for i := range s {
+			s[i] = randomAny(r, depth-1)
+		}
+		return s
+	default:
+		m := make(map[string]interface{})
+		for i := r.Intn(5); i > 0; i-- {
+			v, _ := quick.Value(reflect.TypeOf(""), r)
+			m[v.String()] = randomAny(r, depth-1)
+		}
+		return m
+	}
+}
+
+func TestRoundTrip_interface(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 500; i++ {
+		in := randomAny(r, 3)
+		var out interface{}
+		if err := NewDecoder(bytes.NewReader(encodeObj(t, in))).Decode(&out); err != nil {
+			t.Fatalf("decode %#v: %v", in, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("round trip mismatch:\n got %#v\nwant %#v", out, in)
+		}
+	}
+}
+
+// TestRoundTrip_deterministic 同一个值每次编码的结果都一样，map 的 key 是排过序的
+func TestRoundTrip_deterministic(t *testing.T) {
+	f := func(in map[string]int, im map[int8][]string) bool {
+		return bytes.Equal(encodeObj(t, in), encodeObj(t, in)) && bytes.Equal(encodeObj(t, im), encodeObj(t, im))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nestedSlices 构造 depth 层嵌套的切片，只有最里层是空的
+func nestedSlices(depth int) []byte {
+	lengths := make([]int, depth) // 从里往外每一层 V 部分的长度
+	size := 0
+	for i := range lengths {
+		lengths[i] = size
+		size = tlvSize(core.Slice, size)
+	}
+	data := make([]byte, 0, size)
+	for i := depth - 1; i >= 0; i-- {
+		data = appendTL(data, core.DataTypeStruct, core.Slice, lengths[i])
+	}
+	return data
+}
+
+// TestDecode_tooDeep 深层嵌套的数据在解码之前就被拒绝，不会把栈撑爆
+func TestDecode_tooDeep(t *testing.T) {
+	var v interface{}
+	if err := NewDecoder(bytes.NewReader(nestedSlices(maxDepth))).Decode(&v); err != nil {
+		t.Fatalf("decode %d levels: %v", maxDepth, err)
+	}
+	data := nestedSlices(maxDepth + 1)
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("expect ErrTooDeep, got %v", err)
+	}
+	if err := NewDecoder(nil).DecodeBytes(data, &v); !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("expect ErrTooDeep, got %v", err)
+	}
+	if err := Dump(io.Discard, data); !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("expect ErrTooDeep, got %v", err)
+	}
+}
@@ -1,218 +1,243 @@
 package codec
 
 import (
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
-	"log"
 	"reflect"
 	"tlv/core"
 )
 
+const (
+	// maxVarintBytes tag 的扩展部分以及 length 字段最多占用的字节数，每个字节 7 位，5 个字节足够表示 32G 的长度了
+	maxVarintBytes = 5
+	// defaultBufSize 解码缓冲区的初始大小，放不下时按需扩容
+	defaultBufSize = 1024
+	// maxRetainedBufSize 扩容后的缓冲区超过这个大小的话，解码完就还回去，免得一个大包让连接一直占着大块内存
+	maxRetainedBufSize = 64 * 1024
+	// maxDepth 允许的最大嵌套层数
+	maxDepth = 10000
+)
+
+// DefaultMaxFrameSize 新建的 Decoder 默认允许的最大帧（一个顶层 TLV，包括 T 和 L）大小
+var DefaultMaxFrameSize = 64 * 1024 * 1024
+
 type Decoder struct {
-	reader io.Reader
-	buf    []byte
-	offset int // read offset
+	reader       io.Reader
+	buf          []byte
+	offset       int // read offset
+	maxFrameSize int // 一个顶层 TLV 最多占用的字节数，超过的话返回 ErrLengthOverflow
 }
 
 func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{
-		reader: r,
-		buf:    make([]byte, 1024),
-		offset: 0,
+		reader:       r,
+		buf:          make([]byte, defaultBufSize),
+		offset:       0,
+		maxFrameSize: DefaultMaxFrameSize,
 	}
 }
 
-// Decode 解码器的顶层入口
-func (d *Decoder) Decode(res interface{}) error {
-	resValue := reflect.ValueOf(res)
-	if resValue.Kind() != reflect.Ptr {
-		return errors.New("只能是指针类型")
-	}
+// SetMaxFrameSize 设置允许的最大帧大小，size <= 0 表示不限制
+func (d *Decoder) SetMaxFrameSize(size int) {
+	d.maxFrameSize = size
+}
 
+// Decode 解码器的顶层入口。
+// 不论解码是否成功，都会先把一个完整的 TLV 从流中读出来，这样即使目标类型不匹配，流也不会错位，
+// 调用方还可以继续读下一个 TLV。res 为 nil 时，读出来的 TLV 直接丢弃
+func (d *Decoder) Decode(res interface{}) error {
+	defer d.reset()
 	tag, length, err := d.readTL()
 	if err != nil {
 		return err
 	}
-	n, err := io.ReadFull(d.reader, d.buf[d.offset:d.offset+length])
-	if n < length || err != nil {
+	if d.maxFrameSize > 0 && length > d.maxFrameSize-d.offset {
+		return fmt.Errorf("%w: 帧大小 %d 超过了 %d", ErrLengthOverflow, d.offset+length, d.maxFrameSize)
+	}
+	if err = d.readValue(length); err != nil {
 		return err
 	}
-	decodeTlv(d.buf[d.offset:d.offset+length], tag, reflect.Indirect(resValue))
-	d.reset()
-	return nil
+	if res == nil {
+		return nil
+	}
+	resValue := reflect.ValueOf(res)
+	if resValue.Kind() != reflect.Ptr || resValue.IsNil() {
+		return ErrNotPointer
+	}
+	data := d.buf[d.offset : d.offset+length]
+	if err = checkDepth(tag, data); err != nil {
+		return err
+	}
+	op, err := decoderOf(resValue.Elem().Type())
+	if err != nil {
+		return err
+	}
+	return decodeValue(op, data, tag, resValue.Elem())
 }
 
 // DecodeBytes 解码器的顶层入口
-func (d *Decoder) DecodeBytes(data []byte, res interface{}) {
+func (d *Decoder) DecodeBytes(data []byte, res interface{}) error {
 	resValue := reflect.ValueOf(res)
-	if resValue.Kind() != reflect.Ptr {
-		return
+	if resValue.Kind() != reflect.Ptr || resValue.IsNil() {
+		return ErrNotPointer
+	}
+	tag, length, offset, err := parseTL(data)
+	if err != nil {
+		return err
 	}
-	decode(data, reflect.Indirect(resValue))
+	if err = checkDepth(tag, data[offset:offset+length]); err != nil {
+		return err
+	}
+	op, err := decoderOf(resValue.Elem().Type())
+	if err != nil {
+		return err
+	}
+	_, err = decodeOne(op, data, resValue.Elem())
+	return err
 }
 
-
-
-func (d *Decoder) readTL() (*core.Tag, int, error) {
-	var tag *core.Tag
-	var length int
+// readTL 从流中逐个字节地读出 tag 和 length
+func (d *Decoder) readTL() (core.Tag, int, error) {
 	tagStart := d.offset
-	for {
-		n, err := io.ReadFull(d.reader, d.buf[d.offset:d.offset+1])
-		if n == 0 || err != nil {
-			return nil, 0, fmt.Errorf("从流中读取错误")
-		}
-		d.offset++
-		if d.buf[d.offset-1]&0x80 == 0 {
-			tag = parseTag(d.buf[tagStart:d.offset])
-			break
-		}
+	if err := d.readVarint(maxVarintBytes + 1); err != nil { // 一个字节都没读到的话，返回的是 io.EOF，说明流正常结束了
+		return core.Tag{}, 0, err
+	}
+	tag, err := parseTag(d.buf[tagStart:d.offset])
+	if err != nil {
+		return core.Tag{}, 0, err
 	}
 	lenStart := d.offset
-	for {
-		n, err := io.ReadFull(d.reader, d.buf[d.offset:d.offset+1])
-		if n == 0 || err != nil {
-			return nil, 0, fmt.Errorf("从流中读取错误")
+	if err := d.readVarint(maxVarintBytes); err != nil {
+		return core.Tag{}, 0, truncated(err)
+	}
+	length, err := parseLength(d.buf[lenStart:d.offset])
+	if err != nil {
+		return core.Tag{}, 0, err
+	}
+	return tag, length, nil
+}
+
+// readVarint 一直读到最高位为 0 的字节为止，最多读 max 个字节
+func (d *Decoder) readVarint(max int) error {
+	for i := 0; ; i++ {
+		if i == max {
+			return ErrLengthOverflow
+		}
+		if d.offset >= len(d.buf) {
+			return ErrLengthOverflow
+		}
+		if _, err := io.ReadFull(d.reader, d.buf[d.offset:d.offset+1]); err != nil {
+			if d.offset > 0 {
+				return truncated(err)
+			}
+			return err
 		}
 		d.offset++
 		if d.buf[d.offset-1]&0x80 == 0 {
-			length = parseLength(d.buf[lenStart:d.offset])
-			break
+			return nil
 		}
-
 	}
-	return tag, length, nil
 }
 
+// truncated 读到一半遇到 EOF，说明 TLV 不完整
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %v", ErrTruncated, io.ErrUnexpectedEOF)
+	}
+	return err
+}
 
+// parseTL 从 buf 的开头解析出 tag 和 length，并返回 TL 部分占用的字节数。
+// 会检查 V 部分是否完整地包含在 buf 中，所以调用方可以放心地切片
+func parseTL(buf []byte) (core.Tag, int, int, error) {
+	tagLen, err := varintLen(buf, maxVarintBytes+1)
+	if err != nil {
+		return core.Tag{}, 0, 0, err
+	}
+	tag, err := parseTag(buf[:tagLen])
+	if err != nil {
+		return core.Tag{}, 0, 0, err
+	}
+	lenLen, err := varintLen(buf[tagLen:], maxVarintBytes)
+	if err != nil {
+		return core.Tag{}, 0, 0, err
+	}
+	offset := tagLen + lenLen
+	length, err := parseLength(buf[tagLen:offset])
+	if err != nil {
+		return core.Tag{}, 0, 0, err
+	}
+	if length > len(buf)-offset {
+		return core.Tag{}, 0, 0, fmt.Errorf("%w: 需要 %d 字节，剩余 %d 字节", ErrTruncated, length, len(buf)-offset)
+	}
+	return tag, length, offset, nil
+}
 
-func decode(buf []byte, resElemValue reflect.Value) int {
-	var tag *core.Tag
-	var length int
-	offset := 0
-	tagStart := offset
-	for {
-		if buf[offset]&0x80 == 0 {
-			offset++
-			tag = parseTag(buf[tagStart:offset])
-			break
+// varintLen 返回 buf 开头的变长字段占用的字节数
+func varintLen(buf []byte, max int) (int, error) {
+	for i := 0; i < len(buf); i++ {
+		if i == max {
+			return 0, ErrLengthOverflow
 		}
-		offset++
-	}
-	lenStart := offset
-	for {
-		if buf[offset]&0x80 == 0 {
-			offset++
-			length = parseLength(buf[lenStart:offset])
-			break
+		if buf[i]&0x80 == 0 {
+			return i + 1, nil
 		}
-		offset++
 	}
-	decodeTlv(buf[offset:offset+length], tag, resElemValue)
-	return length + offset
+	return 0, ErrTruncated
 }
 
-func decodeTlv(data []byte, tag *core.Tag, resElemValue reflect.Value) {
-	kind := resElemValue.Kind()
-	switch kind {
-	case reflect.Int8:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			resElemValue.Set(reflect.ValueOf(int8(data[0])))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
-		}
-	case reflect.Uint8:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			resElemValue.Set(reflect.ValueOf(data[0]))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
-		}
-	case reflect.Int16:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			val := make([]byte, 2)
-			copy(val[2-len(data):], data)
-			resElemValue.Set(reflect.ValueOf(int16(binary.BigEndian.Uint16(val))))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
-		}
-	case reflect.Uint16:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			val := make([]byte, 2)
-			copy(val[2-len(data):], data)
-			resElemValue.Set(reflect.ValueOf(binary.BigEndian.Uint16(val)))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
-		}
-	case reflect.Int32:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			val := make([]byte, 4)
-			copy(val[4-len(data):], data)
-			resElemValue.Set(reflect.ValueOf(int32(binary.BigEndian.Uint32(val))))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
-		}
-	case reflect.Uint32:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			val := make([]byte, 4)
-			copy(val[4-len(data):], data)
-			resElemValue.Set(reflect.ValueOf(binary.BigEndian.Uint32(val)))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
-		}
-	case reflect.Int64:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			val := make([]byte, 8)
-			copy(val[8-len(data):], data)
-			resElemValue.Set(reflect.ValueOf(int64(binary.BigEndian.Uint64(val))))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
-		}
-	case reflect.Uint64:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			val := make([]byte, 8)
-			copy(val[8-len(data):], data)
-			resElemValue.Set(reflect.ValueOf(binary.BigEndian.Uint64(val)))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
-		}
-	case reflect.Int:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			val := make([]byte, 8)
-			copy(val[8-len(data):], data)
-			resElemValue.Set(reflect.ValueOf(int(binary.BigEndian.Uint64(val))))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
+// skip 跳过 buf 开头的一个 TLV，返回它占用的字节数
+func skip(buf []byte) (int, error) {
+	_, length, offset, err := parseTL(buf)
+	if err != nil {
+		return 0, err
+	}
+	return length + offset, nil
+}
+
+// checkDepth 检查一个 TLV 的嵌套层数，data 是它的 V 部分。
+// 解码是递归进行的，恶意构造的深层嵌套会把栈撑爆，而栈溢出是没法 recover 的，整个进程都会退出。
+// 所以在解码之前先用一个显式的栈把子 TLV 扫描一遍，基本类型的 V 部分直接跳过
+func checkDepth(tag core.Tag, data []byte) error {
+	if tag.FrameType != core.FrameTypePrimitive || tag.DataType != core.DataTypeStruct {
+		return nil
+	}
+	type container struct {
+		end    int  // V 部分结束的位置
+		fields bool // 子 TLV 前面是否带着字段编号
+	}
+	stack := []container{{end: len(data), fields: tag.TagValue == core.Struct}}
+	for offset := 0; len(stack) > 0; {
+		top := stack[len(stack)-1]
+		if offset >= top.end {
+			stack = stack[:len(stack)-1]
+			continue
 		}
-	case reflect.Uint:
-		if _, ok := core.IntKinds[tag.TagValue]; ok {
-			val := make([]byte, 8)
-			copy(val[8-len(data):], data)
-			resElemValue.Set(reflect.ValueOf(uint(binary.BigEndian.Uint64(val))))
-		} else {
-			log.Printf("目标类型[%s]与编码类型[%s]不匹配！\n", kind.String(), tag.TagValue.String())
+		if top.fields {
+			n, err := varintLen(data[offset:top.end], maxVarintBytes)
+			if err != nil {
+				return err
+			}
+			offset += n
 		}
-	case reflect.String:
-		if tag.TagValue == core.String {
-			resElemValue.Set(reflect.ValueOf(string(data)))
+		tag, length, n, err := parseTL(data[offset:top.end])
+		if err != nil {
+			return err
 		}
-	case reflect.Struct:
-		if tag.DataType != core.DataTypeStruct {
-			return
+		offset += n
+		if tag.FrameType != core.FrameTypePrimitive || tag.DataType != core.DataTypeStruct {
+			offset += length
+			continue
 		}
-		filedNums := resElemValue.NumField()
-		length := 0
-		for i := 0; i < filedNums; i++ {
-			fieldi := resElemValue.Field(i)
-			length += decode(data[length:], reflect.Indirect(fieldi))
+		if len(stack) >= maxDepth {
+			return fmt.Errorf("%w: 超过了 %d 层", ErrTooDeep, maxDepth)
 		}
-	default:
-		log.Printf("tlv decoder: 未支持类型[%s]！\n", kind.String())
+		stack = append(stack, container{end: offset + length, fields: tag.TagValue == core.Struct})
 	}
+	return nil
 }
 
-func parseTag(tagBytes []byte) *core.Tag {
+func parseTag(tagBytes []byte) (core.Tag, error) {
 	frameType := tagBytes[0] & core.FrameTypePrivate
 	dataType := tagBytes[0] & core.DataTypeStruct
 	tagValue := 0
@@ -220,26 +245,25 @@ func parseTag(tagBytes []byte) *core.Tag {
 
 	if byteCount == 1 {
 		tagValue = int(tagBytes[0] & 0x1f)
-		return &core.Tag{
-			FrameType: frameType,
-			DataType:  dataType,
-			TagValue:  core.Kind(tagValue),
+	} else {
+		power := 1
+		for i := 1; i < byteCount; i++ {
+			digit := tagBytes[i]
+			tagValue += int(digit&0x7f) * power
+			power *= 128
 		}
 	}
-	power := 1
-	for i := 1; i < byteCount; i++ {
-		digit := tagBytes[i]
-		tagValue += int(digit&0x7f) * power
-		power *= 128
+	if frameType == core.FrameTypePrimitive && core.Kind(tagValue) > core.Bytes {
+		return core.Tag{}, fmt.Errorf("%w: %d", ErrUnknownTag, tagValue)
 	}
-	return &core.Tag{
+	return core.Tag{
 		FrameType: frameType,
 		DataType:  dataType,
 		TagValue:  core.Kind(tagValue),
-	}
+	}, nil
 }
 
-func parseLength(lenBytes []byte) (length int) {
+func parseLength(lenBytes []byte) (length int, err error) {
 	length = 0
 	power := 1
 	byteCount := len(lenBytes)
@@ -248,9 +272,41 @@ func parseLength(lenBytes []byte) (length int) {
 		length += int(digit&0x7f) * power
 		power *= 128
 	}
-	return length
+	if length < 0 {
+		return 0, ErrLengthOverflow
+	}
+	return length, nil
+}
+
+// readValue 把 length 个字节的 V 部分读到 offset 之后。
+// 缓冲区随着实际读到的数据逐步扩容（每次最多翻倍），免得一个伪造的很大的 length 让解码器还没读到数据就先分配一大块内存
+func (d *Decoder) readValue(length int) error {
+	filled, end := d.offset, d.offset+length
+	for filled < end {
+		if filled == len(d.buf) {
+			size := 2 * len(d.buf)
+			if size > end {
+				size = end
+			}
+			buf := make([]byte, size)
+			copy(buf, d.buf[:filled])
+			d.buf = buf
+		}
+		n := end
+		if n > len(d.buf) {
+			n = len(d.buf)
+		}
+		if _, err := io.ReadFull(d.reader, d.buf[filled:n]); err != nil {
+			return truncated(err)
+		}
+		filled = n
+	}
+	return nil
 }
 
 func (d *Decoder) reset() {
 	d.offset = 0
+	if len(d.buf) > maxRetainedBufSize {
+		d.buf = make([]byte, defaultBufSize)
+	}
 }
@@ -0,0 +1,399 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"tlv/core"
+)
+
+// 解码计划：与编码一样，每个类型第一次解码时生成一个 decOp 并缓存起来，
+// 结构体的字段、切片的元素等子类型的 decOp 在生成时就确定好了，解码时不用再根据 Kind 做分支判断
+
+// decOp 一个类型的解码操作。data 是 V 部分，tag 是这个 TLV 的 T 部分
+type decOp struct {
+	decode  func(data []byte, tag core.Tag, v reflect.Value) error
+	private bool // 是否是私有类型，只有私有类型才能解码私有帧
+}
+
+// 解码计划的缓存。[reflect.Type -> *decOp]
+var (
+	decOps     sync.Map
+	decOpsLock sync.Mutex
+)
+
+func decoderOf(typ reflect.Type) (*decOp, error) {
+	if op, ok := decOps.Load(typ); ok {
+		return op.(*decOp), nil
+	}
+	decOpsLock.Lock()
+	defer decOpsLock.Unlock()
+	building := make(map[reflect.Type]*decOp)
+	op, err := buildDecOp(typ, building)
+	if err != nil {
+		return nil, err
+	}
+	for t, o := range building {
+		decOps.Store(t, o)
+	}
+	return op, nil
+}
+
+// decodeValue 对端编码的是 nil 时，把 v 置为零值；否则交给 op 解码
+func decodeValue(op *decOp, data []byte, tag core.Tag, v reflect.Value) error {
+	if tag.FrameType == core.FrameTypePrivate {
+		if !op.private { // 私有 tag 与基本帧的 Kind 是两套编号，不能交给普通类型解码
+			return mismatch(v, tag)
+		}
+		return op.decode(data, tag, v)
+	}
+	if tag.TagValue == core.Invalid {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	return op.decode(data, tag, v)
+}
+
+// decodeOne 解码 buf 开头的一个 TLV 到 v 中，返回这个 TLV 占用的字节数
+func decodeOne(op *decOp, buf []byte, v reflect.Value) (int, error) {
+	tag, length, offset, err := parseTL(buf)
+	if err != nil {
+		return 0, err
+	}
+	if err = decodeValue(op, buf[offset:offset+length], tag, v); err != nil {
+		return 0, err
+	}
+	return length + offset, nil
+}
+
+func mismatch(v reflect.Value, tag core.Tag) error {
+	return &TypeError{Target: v.Type(), Wire: tag.TagValue}
+}
+
+func buildDecOp(typ reflect.Type, building map[reflect.Type]*decOp) (*decOp, error) {
+	if op, ok := decOps.Load(typ); ok {
+		return op.(*decOp), nil
+	}
+	if op, ok := building[typ]; ok {
+		return op, nil
+	}
+	op := &decOp{}
+	building[typ] = op
+	if pt := lookupPrivateType(typ); pt != nil {
+		*op = *privateDecOp(pt)
+		return op, nil
+	}
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			value, signed, ok := decodeInteger(data, tag)
+			if !ok || (!signed && value > math.MaxInt64) || v.OverflowInt(int64(value)) {
+				return mismatch(v, tag)
+			}
+			v.SetInt(int64(value))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			value, signed, ok := decodeInteger(data, tag)
+			if !ok || (signed && int64(value) < 0) || v.OverflowUint(value) {
+				return mismatch(v, tag)
+			}
+			v.SetUint(value)
+			return nil
+		}
+	case reflect.String:
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			if tag.TagValue != core.String {
+				return mismatch(v, tag)
+			}
+			v.SetString(string(data))
+			return nil
+		}
+	case reflect.Bool:
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			if tag.TagValue != core.Bool || len(data) != 1 {
+				return mismatch(v, tag)
+			}
+			v.SetBool(data[0] != 0)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			switch {
+			case tag.TagValue == core.Float32 && len(data) == 4:
+				v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(data))))
+			case tag.TagValue == core.Float64 && len(data) == 8:
+				v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(data)))
+			default:
+				return mismatch(v, tag)
+			}
+			return nil
+		}
+	case reflect.Complex64, reflect.Complex128:
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			switch {
+			case tag.TagValue == core.Complex64 && len(data) == 8:
+				re := math.Float32frombits(binary.BigEndian.Uint32(data))
+				im := math.Float32frombits(binary.BigEndian.Uint32(data[4:]))
+				v.SetComplex(complex(float64(re), float64(im)))
+			case tag.TagValue == core.Complex128 && len(data) == 16:
+				re := math.Float64frombits(binary.BigEndian.Uint64(data))
+				im := math.Float64frombits(binary.BigEndian.Uint64(data[8:]))
+				v.SetComplex(complex(re, im))
+			default:
+				return mismatch(v, tag)
+			}
+			return nil
+		}
+	case reflect.Struct:
+		if err := buildStructDecOp(op, typ, building); err != nil {
+			return nil, err
+		}
+	case reflect.Ptr:
+		elem, err := buildDecOp(typ.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			if tag.TagValue == core.Ptr && tag.DataType != core.DataTypeStruct { // nil 指针
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			p := reflect.New(v.Type().Elem())
+			var err error
+			if tag.TagValue == core.Ptr {
+				_, err = decodeOne(elem, data, p.Elem())
+			} else { // 对端直接编码了指针指向的值，也兼容一下
+				err = decodeValue(elem, data, tag, p.Elem())
+			}
+			if err != nil {
+				return err
+			}
+			v.Set(p)
+			return nil
+		}
+	case reflect.Slice:
+		elem, err := buildDecOp(typ.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		isBytes := typ.Elem().Kind() == reflect.Uint8
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			if tag.TagValue == core.Bytes && isBytes {
+				valueBytes := make([]byte, len(data))
+				copy(valueBytes, data)
+				v.SetBytes(valueBytes)
+				return nil
+			}
+			if tag.TagValue != core.Slice && tag.TagValue != core.Array {
+				return mismatch(v, tag)
+			}
+			if tag.DataType != core.DataTypeStruct { // nil 切片
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			slice := reflect.MakeSlice(v.Type(), 0, 0)
+			for length := 0; length < len(data); {
+				slice = reflect.Append(slice, reflect.Zero(v.Type().Elem()))
+				n, err := decodeOne(elem, data[length:], slice.Index(slice.Len()-1))
+				if err != nil {
+					return err
+				}
+				length += n
+			}
+			v.Set(slice)
+			return nil
+		}
+	case reflect.Array:
+		elem, err := buildDecOp(typ.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		isBytes := typ.Elem().Kind() == reflect.Uint8
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			if tag.TagValue == core.Bytes && isBytes {
+				for i := 0; i < len(data) && i < v.Len(); i++ {
+					v.Index(i).SetUint(uint64(data[i]))
+				}
+				return nil
+			}
+			if tag.TagValue != core.Slice && tag.TagValue != core.Array {
+				return mismatch(v, tag)
+			}
+			// 元素个数比数组长度多的话，多出来的丢掉
+			for i, length := 0, 0; length < len(data); i++ {
+				var n int
+				var err error
+				if i < v.Len() {
+					n, err = decodeOne(elem, data[length:], v.Index(i))
+				} else {
+					n, err = skip(data[length:])
+				}
+				if err != nil {
+					return err
+				}
+				length += n
+			}
+			return nil
+		}
+	case reflect.Map:
+		key, err := buildDecOp(typ.Key(), building)
+		if err != nil {
+			return nil, err
+		}
+		elem, err := buildDecOp(typ.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			if tag.TagValue != core.Map {
+				return mismatch(v, tag)
+			}
+			if tag.DataType != core.DataTypeStruct { // nil map
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			typ := v.Type()
+			m := reflect.MakeMap(typ)
+			for length := 0; length < len(data); {
+				k := reflect.New(typ.Key()).Elem()
+				n, err := decodeOne(key, data[length:], k)
+				if err != nil {
+					return err
+				}
+				length += n
+				if k.Kind() == reflect.Interface && !k.IsNil() && !k.Elem().Type().Comparable() { // 比如 []interface{} 不能作为 key
+					return mismatch(k, tag)
+				}
+				if length >= len(data) { // 只有 key 没有 value
+					return ErrTruncated
+				}
+				e := reflect.New(typ.Elem()).Elem()
+				n, err = decodeOne(elem, data[length:], e)
+				if err != nil {
+					return err
+				}
+				length += n
+				m.SetMapIndex(k, e)
+			}
+			v.Set(m)
+			return nil
+		}
+	case reflect.Interface:
+		*op = *interfaceDecOp()
+	default:
+		op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+			return fmt.Errorf("tlv: 未支持类型[%s]", v.Type())
+		}
+	}
+	return op, nil
+}
+
+// buildStructDecOp 结构体的解码计划。
+// 带字段编号的编码（TagValue 为 core.Struct）按编号找字段，不认识的编号跳过；
+// 早期的编码不带字段编号，按字段顺序依次解码
+func buildStructDecOp(op *decOp, typ reflect.Type, building map[reflect.Type]*decOp) error {
+	info, err := getStructInfo(typ)
+	if err != nil {
+		return err
+	}
+	type fieldOp struct {
+		index int
+		op    *decOp
+	}
+	byNum := make(map[int]fieldOp, len(info.fields))
+	var positional []fieldOp
+	for i := 0; i < typ.NumField(); i++ {
+		if !isExportedField(typ.Field(i)) { // 与编码时一样，跳过未导出的字段
+			continue
+		}
+		fop, err := buildDecOp(typ.Field(i).Type, building)
+		if err != nil {
+			return err
+		}
+		positional = append(positional, fieldOp{index: i, op: fop})
+	}
+	for _, f := range info.fields {
+		fop, err := buildDecOp(typ.Field(f.index).Type, building)
+		if err != nil {
+			return err
+		}
+		byNum[f.num] = fieldOp{index: f.index, op: fop}
+	}
+	op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+		if tag.DataType != core.DataTypeStruct {
+			return mismatch(v, tag)
+		}
+		if tag.TagValue != core.Struct {
+			for i, length := 0, 0; i < len(positional) && length < len(data); i++ {
+				n, err := decodeOne(positional[i].op, data[length:], v.Field(positional[i].index))
+				if err != nil {
+					return err
+				}
+				length += n
+			}
+			return nil
+		}
+		for length := 0; length < len(data); {
+			numLen, err := varintLen(data[length:], maxVarintBytes)
+			if err != nil {
+				return err
+			}
+			num, err := parseLength(data[length : length+numLen])
+			if err != nil {
+				return err
+			}
+			length += numLen
+			var n int
+			if f, ok := byNum[num]; ok {
+				n, err = decodeOne(f.op, data[length:], v.Field(f.index))
+			} else {
+				n, err = skip(data[length:])
+			}
+			if err != nil {
+				return err
+			}
+			length += n
+		}
+		return nil
+	}
+	return nil
+}
+
+// decodeInteger 解析大端序的整数。编码时会根据数值大小选择 1、2、4、8 字节，
+// 有符号的编码类型需要按照字节数做符号扩展，否则 int8(-1) 解码到 int64 里就成了 255
+func decodeInteger(data []byte, tag core.Tag) (value uint64, signed bool, ok bool) {
+	if _, isInt := core.IntKinds[tag.TagValue]; !isInt {
+		return 0, false, false
+	}
+	switch tag.TagValue {
+	case core.Int, core.Int8, core.Int16, core.Int32, core.Int64:
+		signed = true
+	}
+	switch len(data) {
+	case 1:
+		if signed {
+			return uint64(int8(data[0])), true, true
+		}
+		return uint64(data[0]), false, true
+	case 2:
+		v := binary.BigEndian.Uint16(data)
+		if signed {
+			return uint64(int16(v)), true, true
+		}
+		return uint64(v), false, true
+	case 4:
+		v := binary.BigEndian.Uint32(data)
+		if signed {
+			return uint64(int32(v)), true, true
+		}
+		return uint64(v), false, true
+	case 8:
+		return binary.BigEndian.Uint64(data), signed, true
+	default:
+		return 0, false, false
+	}
+}
@@ -0,0 +1,225 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"tlv/core"
+)
+
+// 不需要 Go 结构体，直接把 TLV 按树形打印出来，用来排查线上抓到的包。每个 TLV 打印一行：
+//   [标签] Kind名 帧类型/数据类型 len=长度 值
+// 嵌套的 TLV 缩进两格打印在下面，结构体的字段前面带着字段编号（#1、#2 ...），
+// 私有帧如果注册过，用注册的解码函数还原出值再打印，否则打印原始字节
+
+// maxDumpBytes 字符串和字节数组最多打印多少个字节，超出的部分用 ... 表示
+const maxDumpBytes = 64
+
+// Dump 依次打印 data 中的所有顶层 TLV，遇到格式错误时返回错误，错误之前的部分已经打印出来了
+func Dump(w io.Writer, data []byte) error {
+	for i, offset := 0, 0; offset < len(data); i++ {
+		n, err := DumpFrame(w, data[offset:], fmt.Sprintf("[%d]", i))
+		if err != nil {
+			return fmt.Errorf("偏移 %d：%w", offset, err)
+		}
+		offset += n
+	}
+	return nil
+}
+
+// DumpFrame 打印 data 开头的一个顶层 TLV，label 打印在行首，返回这个 TLV 占用的字节数
+func DumpFrame(w io.Writer, data []byte, label string) (int, error) {
+	tag, length, offset, err := parseTL(data)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkDepth(tag, data[offset:offset+length]); err != nil {
+		return 0, err
+	}
+	d := &dumper{w: w}
+	n, err := d.dump(data, 0, label)
+	if err != nil {
+		return 0, err
+	}
+	return n, d.err
+}
+
+type dumper struct {
+	w   io.Writer
+	err error // 第一个写入错误
+}
+
+func (d *dumper) printf(depth int, format string, args ...interface{}) {
+	if d.err != nil {
+		return
+	}
+	_, d.err = fmt.Fprintf(d.w, strings.Repeat("  ", depth)+format+"\n", args...)
+}
+
+// dump 打印 buf 开头的一个 TLV 以及它的子 TLV，返回占用的字节数
+func (d *dumper) dump(buf []byte, depth int, label string) (int, error) {
+	tag, length, offset, err := parseTL(buf)
+	if err != nil {
+		return 0, err
+	}
+	data := buf[offset : offset+length]
+	head := fmt.Sprintf("%s%s %s len=%d", prefix(label), kindName(tag), tagTypes(tag), length)
+	switch {
+	case tag.FrameType == core.FrameTypePrivate:
+		d.printf(depth, "%s %s", head, privateValue(tag, data))
+	case tag.DataType == core.DataTypeStruct && tag.TagValue == core.Struct:
+		d.printf(depth, "%s", head)
+		err = d.dumpFields(data, depth+1)
+	case tag.DataType == core.DataTypeStruct:
+		// 切片、数组、map、指针、interface 以及早期不带字段编号的结构体，子 TLV 直接拼在一起
+		d.printf(depth, "%s", head)
+		err = d.dumpElems(data, depth+1)
+	default:
+		d.printf(depth, "%s %s", head, primitiveValue(tag, data))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return offset + length, nil
+}
+
+func (d *dumper) dumpElems(data []byte, depth int) error {
+	for length := 0; length < len(data); {
+		n, err := d.dump(data[length:], depth, "")
+		if err != nil {
+			return err
+		}
+		length += n
+	}
+	return nil
+}
+
+func (d *dumper) dumpFields(data []byte, depth int) error {
+	for length := 0; length < len(data); {
+		numLen, err := varintLen(data[length:], maxVarintBytes)
+		if err != nil {
+			return err
+		}
+		num, err := parseLength(data[length : length+numLen])
+		if err != nil {
+			return err
+		}
+		length += numLen
+		n, err := d.dump(data[length:], depth, fmt.Sprintf("#%d", num))
+		if err != nil {
+			return err
+		}
+		length += n
+	}
+	return nil
+}
+
+func prefix(label string) string {
+	if label == "" {
+		return ""
+	}
+	return label + " "
+}
+
+func kindName(tag core.Tag) string {
+	if tag.FrameType == core.FrameTypePrivate {
+		privateMu.RLock()
+		pt := privateByTag[int(tag.TagValue)]
+		privateMu.RUnlock()
+		if pt != nil {
+			return fmt.Sprintf("private(%d %s)", tag.TagValue, pt.typ)
+		}
+		return fmt.Sprintf("private(%d)", tag.TagValue)
+	}
+	if tag.DataType == core.DataTypeStruct && tag.TagValue != core.Struct && !isContainer(tag.TagValue) {
+		return fmt.Sprintf("struct(%s)", tag.TagValue) // 早期的结构体编码，TagValue 不是 core.Struct
+	}
+	return tag.TagValue.String()
+}
+
+func isContainer(kind core.Kind) bool {
+	switch kind {
+	case core.Slice, core.Array, core.Map, core.Ptr, core.Interface:
+		return true
+	}
+	return false
+}
+
+func tagTypes(tag core.Tag) string {
+	frame, data := "primitive", "primitive"
+	if tag.FrameType == core.FrameTypePrivate {
+		frame = "private"
+	}
+	if tag.DataType == core.DataTypeStruct {
+		data = "struct"
+	}
+	return frame + "/" + data
+}
+
+func privateValue(tag core.Tag, data []byte) string {
+	privateMu.RLock()
+	pt := privateByTag[int(tag.TagValue)]
+	privateMu.RUnlock()
+	if pt != nil {
+		if v, err := pt.unmarshal(data); err == nil {
+			return fmt.Sprintf("= %v", v)
+		}
+	}
+	return "= " + hexBytes(data)
+}
+
+func primitiveValue(tag core.Tag, data []byte) string {
+	switch tag.TagValue {
+	case core.Invalid, core.Ptr, core.Slice, core.Map:
+		if len(data) == 0 {
+			return "= nil"
+		}
+	case core.Bool:
+		if len(data) == 1 {
+			return fmt.Sprintf("= %t", data[0] != 0)
+		}
+	case core.Float32:
+		if len(data) == 4 {
+			return fmt.Sprintf("= %v", math.Float32frombits(binary.BigEndian.Uint32(data)))
+		}
+	case core.Float64:
+		if len(data) == 8 {
+			return fmt.Sprintf("= %v", math.Float64frombits(binary.BigEndian.Uint64(data)))
+		}
+	case core.Complex64:
+		if len(data) == 8 {
+			re := math.Float32frombits(binary.BigEndian.Uint32(data))
+			im := math.Float32frombits(binary.BigEndian.Uint32(data[4:]))
+			return fmt.Sprintf("= %v", complex(re, im))
+		}
+	case core.Complex128:
+		if len(data) == 16 {
+			re := math.Float64frombits(binary.BigEndian.Uint64(data))
+			im := math.Float64frombits(binary.BigEndian.Uint64(data[8:]))
+			return fmt.Sprintf("= %v", complex(re, im))
+		}
+	case core.String:
+		if len(data) > maxDumpBytes {
+			return fmt.Sprintf("= %q...", data[:maxDumpBytes])
+		}
+		return fmt.Sprintf("= %q", data)
+	default:
+		if value, signed, ok := decodeInteger(data, tag); ok {
+			if signed {
+				return fmt.Sprintf("= %d", int64(value))
+			}
+			return fmt.Sprintf("= %d", value)
+		}
+	}
+	return "= " + hexBytes(data) // 长度对不上或者是字节数组，打印原始字节
+}
+
+func hexBytes(data []byte) string {
+	if len(data) > maxDumpBytes {
+		return "0x" + hex.EncodeToString(data[:maxDumpBytes]) + "..."
+	}
+	return "0x" + hex.EncodeToString(data)
+}
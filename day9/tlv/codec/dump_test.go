@@ -0,0 +1,57 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+type dumpShape struct {
+	Name  string
+	Sides int
+}
+
+func init() {
+	if err := Register(dumpShape{}); err != nil {
+		panic(err)
+	}
+}
+
+type dumpArgs struct {
+	Value interface{}
+	List  []interface{}
+}
+
+func TestDump(t *testing.T) {
+	data, err := NewEncoder(ioutil.Discard).EncodeObj(&dumpArgs{
+		Value: dumpShape{Name: "a", Sides: 3},
+		List:  []interface{}{int8(-1), nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = Dump(&out, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"[0] struct primitive/struct len=",
+		"  #1 interface primitive/struct len=",
+		`    string primitive/primitive len=15 = "codec.dumpShape"`,
+		"      #2 int8 primitive/primitive len=1 = 3",
+		"    int8 primitive/primitive len=1 = -1",
+		"    invalid primitive/primitive len=0 = nil",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(line)) {
+			t.Fatalf("expect %q in:\n%s", line, out.String())
+		}
+	}
+	// DumpFrame 只打印开头的一个 TLV
+	if n, err := DumpFrame(ioutil.Discard, append(data, data...), "x"); err != nil || n != len(data) {
+		t.Fatalf("expect %d bytes, got %d, %v", len(data), n, err)
+	}
+	if err = Dump(ioutil.Discard, data[:len(data)-1]); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expect ErrTruncated, got %v", err)
+	}
+}
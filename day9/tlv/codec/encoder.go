@@ -2,9 +2,7 @@ package codec
 
 import (
 	"encoding/binary"
-	"fmt"
 	"io"
-	"log"
 	"math"
 	"reflect"
 	"tlv/core"
@@ -55,6 +53,41 @@ func (e *Encoder) EncodeBool(value bool) ([]byte, error) {
 	return e.EncodePrimitive(core.Bool, valueBytes), nil
 }
 
+// EncodeFloat32 浮点数按照 IEEE-754 的位模式，以大端序写入
+func (e *Encoder) EncodeFloat32(value float32) ([]byte, error) {
+	valueBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(valueBytes, math.Float32bits(value))
+	return e.EncodePrimitive(core.Float32, valueBytes), nil
+}
+
+func (e *Encoder) EncodeFloat64(value float64) ([]byte, error) {
+	valueBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(valueBytes, math.Float64bits(value))
+	return e.EncodePrimitive(core.Float64, valueBytes), nil
+}
+
+// EncodeComplex64 复数先写实部，再写虚部
+func (e *Encoder) EncodeComplex64(value complex64) ([]byte, error) {
+	valueBytes := make([]byte, 8)
+	binary.BigEndian.PutUint32(valueBytes, math.Float32bits(real(value)))
+	binary.BigEndian.PutUint32(valueBytes[4:], math.Float32bits(imag(value)))
+	return e.EncodePrimitive(core.Complex64, valueBytes), nil
+}
+
+func (e *Encoder) EncodeComplex128(value complex128) ([]byte, error) {
+	valueBytes := make([]byte, 16)
+	binary.BigEndian.PutUint64(valueBytes, math.Float64bits(real(value)))
+	binary.BigEndian.PutUint64(valueBytes[8:], math.Float64bits(imag(value)))
+	return e.EncodePrimitive(core.Complex128, valueBytes), nil
+}
+
+// EncodeBytes 原始字节直接作为 Value，不像普通切片那样每个元素都带一个 TL
+func (e *Encoder) EncodeBytes(value []byte) ([]byte, error) {
+	valueBytes := make([]byte, len(value))
+	copy(valueBytes, value)
+	return e.EncodePrimitive(core.Bytes, valueBytes), nil
+}
+
 func (e *Encoder) EncodeInt8(value int8) ([]byte, error) {
 	return e.encodeUint8(core.Int8, uint8(value))
 }
@@ -149,43 +182,26 @@ func (e *Encoder) EncodeVarUint(value uint64) ([]byte, error) {
 	return bytes, err
 }
 
+// EncodeObj 把 input 编码成一个 TLV 并返回它的字节数据
 func (e *Encoder) EncodeObj(input interface{}) ([]byte, error) {
-	inVal := reflect.Indirect(reflect.ValueOf(input))
-	kind := inVal.Kind()
-	switch kind {
-	case reflect.Invalid:
-		return e.EncodePrimitive(core.Invalid, []byte{}), nil
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return e.EncodeVarInt(inVal.Int())
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return e.EncodeVarUint(inVal.Uint())
-	case reflect.String:
-		return e.EncodeString(inVal.String())
-	case reflect.Struct:
-		numField := inVal.NumField()
-		var innerBytes []byte
-		for i := 0; i < numField; i++ {
-			bytes, _ := e.EncodeObj(inVal.Field(i).Interface())
-			innerBytes = append(innerBytes, bytes...)
-		}
-		res := e.EncodeStruct(1, innerBytes)
-		return res, nil
-	default:
-		return nil, fmt.Errorf("不支持的类型：%s", kind.String())
+	s := getEncState()
+	defer putEncState(s)
+	// 顶层的指针直接解引用，参数和返回值一般都是以指针的形式传进来的
+	if err := s.encode(reflect.Indirect(reflect.ValueOf(input))); err != nil {
+		return nil, err
 	}
+	res := make([]byte, len(s.buf))
+	copy(res, s.buf)
+	return res, nil
 }
 
+// Encode 把 input 编码后写入 writer。编码用的缓冲区来自 sync.Pool，不会为每次编码都分配新的内存
 func (e *Encoder) Encode(input interface{}) error {
-	bytes, err := e.EncodeObj(input)
-	if err != nil {
-		log.Printf("写入失败")
-		return err
-	}
-	bytes = append(bytes, )
-
-	if _, err = e.writer.Write(bytes); err != nil {
-		log.Printf("写入失败")
+	s := getEncState()
+	defer putEncState(s)
+	if err := s.encode(reflect.Indirect(reflect.ValueOf(input))); err != nil {
 		return err
 	}
-	return nil
+	_, err := e.writer.Write(s.buf)
+	return err
 }
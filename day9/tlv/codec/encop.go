@@ -0,0 +1,552 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"tlv/core"
+)
+
+// 编码计划：每个类型第一次编码时，根据它的 Kind 生成一个 encOp 并缓存起来，之后再编码同一类型就不用再对 Kind 做分支判断了。
+// 一次编码分两趟：
+//   1. size 趟：递归计算出每个嵌套 TLV 的 V 部分长度，按先序记录在 encState.sizes 中，同时得到整个 TLV 的大小
+//   2. write 趟：按同样的顺序取出长度，把 T、L、V 直接追加到一块预先分配好大小的缓冲区中
+// 这样整个编码过程中只有这一块缓冲区，而且 encState 是从 sync.Pool 中复用的，基本类型和结构体的编码不需要额外分配内存
+
+// encOp 一个类型的编码操作
+type encOp struct {
+	size  func(s *encState, v reflect.Value) (int, error) // 返回整个 TLV（T + L + V）的字节数
+	write func(s *encState, v reflect.Value)              // 把 TLV 追加到 s.buf 中，只会在 size 成功之后调用
+}
+
+// encState 一次编码的状态
+type encState struct {
+	buf        []byte            // 编码结果
+	sizes      []int             // 嵌套 TLV 的 V 部分长度，按先序记录
+	keys       [][]reflect.Value // map 排好序的 key，同样按先序记录，保证两趟遍历的顺序一致
+	private    [][]byte          // 私有类型编码函数的结果，同样按先序记录
+	sizeIdx    int               // write 趟读到了第几个 size
+	keyIdx     int               // write 趟读到了第几组 key
+	privateIdx int               // write 趟读到了第几个私有类型
+}
+
+// maxPooledBufSize 超过这个大小的缓冲区不放回池子里，免得一次大包让池子一直占着大块内存
+const maxPooledBufSize = 64 * 1024
+
+var encStatePool = sync.Pool{
+	New: func() interface{} {
+		return &encState{buf: make([]byte, 0, 1024)}
+	},
+}
+
+func getEncState() *encState {
+	return encStatePool.Get().(*encState)
+}
+
+func putEncState(s *encState) {
+	if cap(s.buf) > maxPooledBufSize {
+		return
+	}
+	s.buf = s.buf[:0]
+	s.sizes = s.sizes[:0]
+	for i := range s.keys {
+		s.keys[i] = nil
+	}
+	s.keys = s.keys[:0]
+	for i := range s.private {
+		s.private[i] = nil
+	}
+	s.private = s.private[:0]
+	s.sizeIdx, s.keyIdx, s.privateIdx = 0, 0, 0
+	encStatePool.Put(s)
+}
+
+// encode 把 v 编码追加到 s.buf 中
+func (s *encState) encode(v reflect.Value) error {
+	if !v.IsValid() { // nil
+		s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Invalid, 0)
+		return nil
+	}
+	op, err := encoderOf(v.Type())
+	if err != nil {
+		return err
+	}
+	size, err := op.size(s, v)
+	if err != nil {
+		return err
+	}
+	if cap(s.buf)-len(s.buf) < size {
+		buf := make([]byte, len(s.buf), len(s.buf)+size)
+		copy(buf, s.buf)
+		s.buf = buf
+	}
+	op.write(s, v)
+	return nil
+}
+
+// reserveSize 为一个嵌套 TLV 占一个位置，等子 TLV 的大小算完了再填进去
+func (s *encState) reserveSize() int {
+	s.sizes = append(s.sizes, 0)
+	return len(s.sizes) - 1
+}
+
+func (s *encState) nextSize() int {
+	size := s.sizes[s.sizeIdx]
+	s.sizeIdx++
+	return size
+}
+
+// 编码计划的缓存。[reflect.Type -> *encOp]
+var (
+	encOps     sync.Map
+	encOpsLock sync.Mutex // 生成编码计划时加锁，保证递归类型生成完整之后才对外可见
+)
+
+func encoderOf(typ reflect.Type) (*encOp, error) {
+	if op, ok := encOps.Load(typ); ok {
+		return op.(*encOp), nil
+	}
+	encOpsLock.Lock()
+	defer encOpsLock.Unlock()
+	building := make(map[reflect.Type]*encOp)
+	op, err := buildEncOp(typ, building)
+	if err != nil {
+		return nil, err
+	}
+	for t, o := range building {
+		encOps.Store(t, o)
+	}
+	return op, nil
+}
+
+// buildEncOp 生成 typ 的编码计划。building 中记录了正在生成的计划，递归类型（比如链表）引用自己时直接拿到这个占位的 encOp
+func buildEncOp(typ reflect.Type, building map[reflect.Type]*encOp) (*encOp, error) {
+	if op, ok := encOps.Load(typ); ok {
+		return op.(*encOp), nil
+	}
+	if op, ok := building[typ]; ok {
+		return op, nil
+	}
+	op := &encOp{}
+	building[typ] = op
+	if pt := lookupPrivateType(typ); pt != nil {
+		*op = *privateEncOp(pt)
+		return op, nil
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		op.size = fixedSize(1)
+		op.write = func(s *encState, v reflect.Value) {
+			var b byte
+			if v.Bool() {
+				b = 1
+			}
+			s.buf = append(appendTL(s.buf, core.DataTypePrimitive, core.Bool, 1), b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		op.size = func(s *encState, v reflect.Value) (int, error) {
+			_, width := intKind(v.Int())
+			return 2 + width, nil
+		}
+		op.write = func(s *encState, v reflect.Value) {
+			kind, width := intKind(v.Int())
+			s.buf = appendUint(appendTL(s.buf, core.DataTypePrimitive, kind, width), uint64(v.Int()), width)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		op.size = func(s *encState, v reflect.Value) (int, error) {
+			_, width := uintKind(v.Uint())
+			return 2 + width, nil
+		}
+		op.write = func(s *encState, v reflect.Value) {
+			kind, width := uintKind(v.Uint())
+			s.buf = appendUint(appendTL(s.buf, core.DataTypePrimitive, kind, width), v.Uint(), width)
+		}
+	case reflect.Float32:
+		op.size = fixedSize(4)
+		op.write = func(s *encState, v reflect.Value) {
+			s.buf = appendUint(appendTL(s.buf, core.DataTypePrimitive, core.Float32, 4), uint64(math.Float32bits(float32(v.Float()))), 4)
+		}
+	case reflect.Float64:
+		op.size = fixedSize(8)
+		op.write = func(s *encState, v reflect.Value) {
+			s.buf = appendUint(appendTL(s.buf, core.DataTypePrimitive, core.Float64, 8), math.Float64bits(v.Float()), 8)
+		}
+	case reflect.Complex64:
+		op.size = fixedSize(8)
+		op.write = func(s *encState, v reflect.Value) {
+			c := v.Complex()
+			s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Complex64, 8)
+			s.buf = appendUint(s.buf, uint64(math.Float32bits(float32(real(c)))), 4)
+			s.buf = appendUint(s.buf, uint64(math.Float32bits(float32(imag(c)))), 4)
+		}
+	case reflect.Complex128:
+		op.size = fixedSize(16)
+		op.write = func(s *encState, v reflect.Value) {
+			c := v.Complex()
+			s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Complex128, 16)
+			s.buf = appendUint(s.buf, math.Float64bits(real(c)), 8)
+			s.buf = appendUint(s.buf, math.Float64bits(imag(c)), 8)
+		}
+	case reflect.String:
+		op.size = func(s *encState, v reflect.Value) (int, error) {
+			return tlvSize(core.String, v.Len()), nil
+		}
+		op.write = func(s *encState, v reflect.Value) {
+			s.buf = append(appendTL(s.buf, core.DataTypePrimitive, core.String, v.Len()), v.String()...)
+		}
+	case reflect.Struct:
+		info, err := getStructInfo(typ)
+		if err != nil {
+			return nil, err
+		}
+		type fieldOp struct {
+			field
+			op *encOp
+		}
+		fields := make([]fieldOp, len(info.fields))
+		for i, f := range info.fields {
+			fop, err := buildEncOp(typ.Field(f.index).Type, building)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = fieldOp{field: f, op: fop}
+		}
+		// 每个字段都写成 [字段编号][字段的 TLV]
+		op.size = func(s *encState, v reflect.Value) (int, error) {
+			slot := s.reserveSize()
+			inner := 0
+			for _, f := range fields {
+				n, err := f.op.size(s, v.Field(f.index))
+				if err != nil {
+					return 0, err
+				}
+				inner += varintSize(f.num) + n
+			}
+			s.sizes[slot] = inner
+			return tlvSize(core.Struct, inner), nil
+		}
+		op.write = func(s *encState, v reflect.Value) {
+			s.buf = appendTL(s.buf, core.DataTypeStruct, core.Struct, s.nextSize())
+			for _, f := range fields {
+				s.buf = appendVarint(s.buf, f.num)
+				f.op.write(s, v.Field(f.index))
+			}
+		}
+	case reflect.Ptr:
+		elem, err := buildEncOp(typ.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		op.size = func(s *encState, v reflect.Value) (int, error) {
+			if v.IsNil() {
+				return 2, nil
+			}
+			slot := s.reserveSize()
+			inner, err := elem.size(s, v.Elem())
+			if err != nil {
+				return 0, err
+			}
+			s.sizes[slot] = inner
+			return tlvSize(core.Ptr, inner), nil
+		}
+		op.write = func(s *encState, v reflect.Value) {
+			if v.IsNil() {
+				s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Ptr, 0)
+				return
+			}
+			s.buf = appendTL(s.buf, core.DataTypeStruct, core.Ptr, s.nextSize())
+			elem.write(s, v.Elem())
+		}
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 { // []byte 直接写原始字节
+			op.size = func(s *encState, v reflect.Value) (int, error) {
+				if v.IsNil() {
+					return 2, nil
+				}
+				return tlvSize(core.Bytes, v.Len()), nil
+			}
+			op.write = func(s *encState, v reflect.Value) {
+				if v.IsNil() {
+					s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Slice, 0)
+					return
+				}
+				s.buf = append(appendTL(s.buf, core.DataTypePrimitive, core.Bytes, v.Len()), v.Bytes()...)
+			}
+			break
+		}
+		elems, err := buildElemsOp(typ.Elem(), core.Slice, building)
+		if err != nil {
+			return nil, err
+		}
+		op.size = func(s *encState, v reflect.Value) (int, error) {
+			if v.IsNil() {
+				return 2, nil
+			}
+			return elems.size(s, v)
+		}
+		op.write = func(s *encState, v reflect.Value) {
+			if v.IsNil() {
+				s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Slice, 0)
+				return
+			}
+			elems.write(s, v)
+		}
+	case reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 { // [N]byte 同样直接写原始字节
+			op.size = func(s *encState, v reflect.Value) (int, error) {
+				return tlvSize(core.Bytes, v.Len()), nil
+			}
+			op.write = func(s *encState, v reflect.Value) {
+				s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Bytes, v.Len())
+				for i := 0; i < v.Len(); i++ {
+					s.buf = append(s.buf, byte(v.Index(i).Uint()))
+				}
+			}
+			break
+		}
+		elems, err := buildElemsOp(typ.Elem(), core.Array, building)
+		if err != nil {
+			return nil, err
+		}
+		*op = *elems
+	case reflect.Map:
+		key, err := buildEncOp(typ.Key(), building)
+		if err != nil {
+			return nil, err
+		}
+		elem, err := buildEncOp(typ.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		// 按 key1 value1 key2 value2 ... 的顺序编码，key 排过序，同一个 map 每次编码的结果都一样
+		op.size = func(s *encState, v reflect.Value) (int, error) {
+			if v.IsNil() {
+				return 2, nil
+			}
+			keys, err := sortedKeys(v, key)
+			if err != nil {
+				return 0, err
+			}
+			s.keys = append(s.keys, keys)
+			slot := s.reserveSize()
+			inner := 0
+			for _, k := range keys {
+				kn, err := key.size(s, k)
+				if err != nil {
+					return 0, err
+				}
+				vn, err := elem.size(s, v.MapIndex(k))
+				if err != nil {
+					return 0, err
+				}
+				inner += kn + vn
+			}
+			s.sizes[slot] = inner
+			return tlvSize(core.Map, inner), nil
+		}
+		op.write = func(s *encState, v reflect.Value) {
+			if v.IsNil() {
+				s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Map, 0)
+				return
+			}
+			keys := s.keys[s.keyIdx]
+			s.keyIdx++
+			s.buf = appendTL(s.buf, core.DataTypeStruct, core.Map, s.nextSize())
+			for _, k := range keys {
+				key.write(s, k)
+				elem.write(s, v.MapIndex(k))
+			}
+		}
+	case reflect.Interface:
+		*op = *interfaceEncOp()
+	default:
+		err := fmt.Errorf("不支持的类型：%s", typ)
+		op.size = func(s *encState, v reflect.Value) (int, error) {
+			return 0, err
+		}
+		op.write = func(s *encState, v reflect.Value) {}
+	}
+	return op, nil
+}
+
+// buildElemsOp 切片和数组的编码方式相同：把所有元素的 TLV 拼在一起作为 V
+func buildElemsOp(elemType reflect.Type, kind core.Kind, building map[reflect.Type]*encOp) (*encOp, error) {
+	elem, err := buildEncOp(elemType, building)
+	if err != nil {
+		return nil, err
+	}
+	return &encOp{
+		size: func(s *encState, v reflect.Value) (int, error) {
+			slot := s.reserveSize()
+			inner := 0
+			for i := 0; i < v.Len(); i++ {
+				n, err := elem.size(s, v.Index(i))
+				if err != nil {
+					return 0, err
+				}
+				inner += n
+			}
+			s.sizes[slot] = inner
+			return tlvSize(kind, inner), nil
+		},
+		write: func(s *encState, v reflect.Value) {
+			s.buf = appendTL(s.buf, core.DataTypeStruct, kind, s.nextSize())
+			for i := 0; i < v.Len(); i++ {
+				elem.write(s, v.Index(i))
+			}
+		},
+	}, nil
+}
+
+// sortedKeys 返回排好序的 map key。常见的 key 类型直接按值排序，其余的按编码后的字节排序
+func sortedKeys(v reflect.Value, key *encOp) ([]reflect.Value, error) {
+	keys := v.MapKeys()
+	switch v.Type().Key().Kind() {
+	case reflect.String:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Int() < keys[j].Int() })
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Uint() < keys[j].Uint() })
+	case reflect.Float32, reflect.Float64:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Float() < keys[j].Float() })
+	case reflect.Bool:
+		sort.Slice(keys, func(i, j int) bool { return !keys[i].Bool() && keys[j].Bool() })
+	default:
+		encoded := make([][]byte, len(keys))
+		for i, k := range keys {
+			s := &encState{}
+			if err := s.encodeWith(key, k); err != nil {
+				return nil, err
+			}
+			encoded[i] = s.buf
+		}
+		sort.Sort(byEncoded{keys: keys, encoded: encoded})
+	}
+	return keys, nil
+}
+
+// encodeWith 用指定的编码计划编码 v
+func (s *encState) encodeWith(op *encOp, v reflect.Value) error {
+	if _, err := op.size(s, v); err != nil {
+		return err
+	}
+	op.write(s, v)
+	return nil
+}
+
+type byEncoded struct {
+	keys    []reflect.Value
+	encoded [][]byte
+}
+
+func (b byEncoded) Len() int { return len(b.keys) }
+func (b byEncoded) Less(i, j int) bool {
+	return bytes.Compare(b.encoded[i], b.encoded[j]) < 0
+}
+func (b byEncoded) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.encoded[i], b.encoded[j] = b.encoded[j], b.encoded[i]
+}
+
+// fixedSize 基本类型的 T 和 L 各占 1 个字节
+func fixedSize(n int) func(s *encState, v reflect.Value) (int, error) {
+	return func(s *encState, v reflect.Value) (int, error) {
+		return 2 + n, nil
+	}
+}
+
+// intKind 与 EncodeVarInt 一样，根据数值大小选择占用字节数最少的类型
+func intKind(value int64) (core.Kind, int) {
+	switch {
+	case math.MinInt8 <= value && value <= math.MaxInt8:
+		return core.Int8, 1
+	case math.MinInt16 <= value && value <= math.MaxInt16:
+		return core.Int16, 2
+	case math.MinInt32 <= value && value <= math.MaxInt32:
+		return core.Int32, 4
+	default:
+		return core.Int64, 8
+	}
+}
+
+func uintKind(value uint64) (core.Kind, int) {
+	switch {
+	case value <= math.MaxUint8:
+		return core.Uint8, 1
+	case value <= math.MaxUint16:
+		return core.Uint16, 2
+	case value <= math.MaxUint32:
+		return core.Uint32, 4
+	default:
+		return core.Uint64, 8
+	}
+}
+
+// appendUint 以大端序追加 width 个字节
+func appendUint(buf []byte, value uint64, width int) []byte {
+	switch width {
+	case 1:
+		return append(buf, byte(value))
+	case 2:
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(value))
+		return append(buf, b[:]...)
+	case 4:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(value))
+		return append(buf, b[:]...)
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], value)
+		return append(buf, b[:]...)
+	}
+}
+
+// appendTL 追加 tag 和 length，编码方式与 core.Pkg 相同（基本帧）
+func appendTL(buf []byte, dataType byte, kind core.Kind, length int) []byte {
+	buf = appendTag(buf, core.FrameTypePrimitive, dataType, int(kind))
+	return appendVarint(buf, length)
+}
+
+// appendTag tag 值不超过 0x1f 时只占 1 个字节；否则第 1 个字节最高位置 1，后面跟变长编码的 tag 值
+func appendTag(buf []byte, frameType, dataType byte, tagValue int) []byte {
+	if tagValue <= 0x1f {
+		return append(buf, byte(tagValue)|frameType|dataType)
+	}
+	buf = append(buf, 0x80|frameType|dataType)
+	return appendVarint(buf, tagValue)
+}
+
+func appendVarint(buf []byte, value int) []byte {
+	for value >= 0x80 {
+		buf = append(buf, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(buf, byte(value))
+}
+
+func varintSize(value int) int {
+	n := 1
+	for value >= 0x80 {
+		value >>= 7
+		n++
+	}
+	return n
+}
+
+func tagSize(tagValue int) int {
+	if tagValue <= 0x1f {
+		return 1
+	}
+	return 1 + varintSize(tagValue)
+}
+
+// tlvSize 基本帧的 TLV 大小
+func tlvSize(kind core.Kind, length int) int {
+	return tagSize(int(kind)) + varintSize(length) + length
+}
@@ -0,0 +1,28 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"tlv/core"
+)
+
+// 解码过程中可能出现的错误。解码器不再打印日志后把目标值留成零值，而是把错误一路返回给调用方，
+// 调用方可以用 errors.Is / errors.As 判断具体是哪一种
+var (
+	ErrTruncated      = errors.New("tlv: 数据不完整")           // 数据在一个 TLV 的中间就结束了
+	ErrLengthOverflow = errors.New("tlv: 长度超出限制")          // tag 或 length 字段过长，或者 length 超出了允许的范围
+	ErrUnknownTag     = errors.New("tlv: 未知的 tag")         // 基本帧中出现了 core 中没有定义的 Kind
+	ErrNotPointer     = errors.New("tlv: 只能解码到非 nil 的指针中") // Decode 的参数不是指针
+	ErrTooDeep        = errors.New("tlv: 嵌套层数超出限制")        // 嵌套的层数太多，继续递归解码会导致栈溢出
+)
+
+// TypeError 编码类型与目标类型不匹配，或者编码的值放不进目标类型（比如数值溢出）
+type TypeError struct {
+	Target reflect.Type // 目标类型
+	Wire   core.Kind    // 编码类型
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("tlv: 目标类型[%s]与编码类型[%s]不匹配", e.Target, e.Wire)
+}
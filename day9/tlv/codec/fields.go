@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 结构体按字段编号编码，类似 protobuf：
+//   - 结构体的 Value 部分由若干个 [字段编号][字段的 TLV] 组成，字段编号使用与 length 相同的变长编码
+//   - 字段编号通过 `tlv:"3"` 这样的标签指定，没有标签的字段默认使用它在结构体中的序号（从 1 开始），`tlv:"-"` 表示不参与编解码
+//   - 解码时按编号找字段，不认识的编号直接跳过，没有出现的字段保持原值（新分配的值就是零值）
+// 这样给结构体增加、删除、调整字段顺序的时候，只要已有字段的编号不变，新旧两端就可以互通
+
+// tagName 结构体标签的名字
+const tagName = "tlv"
+
+// field 描述了一个参与编解码的字段
+type field struct {
+	index int    // 字段在结构体中的下标
+	num   int    // 字段编号
+	name  string // 字段名，出错时用来提示
+}
+
+// structInfo 一个结构体类型的字段信息
+type structInfo struct {
+	fields []field       // 按结构体中的顺序排列
+	byNum  map[int]field // [字段编号 -> 字段]
+}
+
+// structInfos 每个结构体类型只解析一次标签。[reflect.Type -> *structInfo]
+var structInfos sync.Map
+
+// getStructInfo 解析结构体类型的字段编号，编号重复或者不合法时返回错误
+func getStructInfo(typ reflect.Type) (*structInfo, error) {
+	if info, ok := structInfos.Load(typ); ok {
+		return info.(*structInfo), nil
+	}
+	info := &structInfo{byNum: make(map[int]field)}
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		if !isExportedField(sf) { // 未导出的字段不参与编解码
+			continue
+		}
+		num := i + 1
+		if tag, ok := sf.Tag.Lookup(tagName); ok {
+			tag = strings.TrimSpace(strings.Split(tag, ",")[0])
+			if tag == "-" {
+				continue
+			}
+			n, err := strconv.Atoi(tag)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("tlv: %s.%s 的字段编号[%s]不合法，必须是正整数", typ, sf.Name, tag)
+			}
+			num = n
+		}
+		if dup, ok := info.byNum[num]; ok {
+			return nil, fmt.Errorf("tlv: %s 的字段 %s 与 %s 使用了相同的编号 %d", typ, dup.name, sf.Name, num)
+		}
+		f := field{index: i, num: num, name: sf.Name}
+		info.fields = append(info.fields, f)
+		info.byNum[num] = f
+	}
+	actual, _ := structInfos.LoadOrStore(typ, info)
+	return actual.(*structInfo), nil
+}
+
+// isExportedField 判断结构体字段是否导出，只有导出的字段才会被编解码
+func isExportedField(field reflect.StructField) bool {
+	return field.PkgPath == ""
+}
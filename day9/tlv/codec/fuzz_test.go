@@ -0,0 +1,100 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// 解码器处理的是从网络上读到的不可信数据，不管输入是什么都只能返回错误，不能 panic、死循环或者按 length 分配巨大的内存。
+// 运行：go test -fuzz=FuzzDecode ./codec/
+
+// fuzzMaxFrameSize 模糊测试时限制帧大小，免得一个很大的 length 把内存耗光
+const fuzzMaxFrameSize = 1 << 20
+
+type fuzzArgs struct {
+	Num    int
+	Name   string
+	Flag   bool
+	Score  float64
+	Data   []byte
+	Tags   []string
+	Attrs  map[string]int
+	Next   *fuzzArgs
+	At     time.Time
+	Any    interface{}
+	Err    error
+	Matrix [2][]int8
+}
+
+// fuzzTargets 每一份输入都尝试解码到这些类型中
+func fuzzTargets() []interface{} {
+	return []interface{}{
+		new(fuzzArgs),
+		new(interface{}),
+		new(map[string]interface{}),
+		new([]interface{}),
+		new(map[int]*fuzzArgs),
+		new(string),
+		new(uint8),
+		new([4]byte),
+	}
+}
+
+// fuzzSeeds 正常编码出来的数据，以及几种典型的错误数据
+func fuzzSeeds(f *testing.F) {
+	next := &fuzzArgs{Num: -1, Tags: []string{}}
+	seeds := []interface{}{
+		&fuzzArgs{
+			Num: 42, Name: "geerpc", Flag: true, Score: 1.5, Data: []byte{1, 2, 3},
+			Tags: []string{"a", "b"}, Attrs: map[string]int{"x": 1}, Next: next,
+			At: time.Unix(1625097600, 0), Any: map[string]interface{}{"k": []interface{}{int64(1), "v"}},
+			Matrix: [2][]int8{{1}, {-2}},
+		},
+		map[string]interface{}{"nested": map[string]interface{}{"ok": true}},
+		[]interface{}{nil, uint64(1 << 40), 3.14, []byte("raw")},
+		"string",
+		uint8(7),
+	}
+	for _, seed := range seeds {
+		data, err := NewEncoder(io.Discard).EncodeObj(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x39})                               // 只有 tag
+	f.Add([]byte{0x39, 0xff, 0xff, 0xff, 0xff, 0x0f}) // 很大的 length
+	f.Add([]byte{0xbf, 0xff, 0xff, 0xff, 0xff, 0xff}) // 过长的 tag
+	f.Add([]byte{0x59, 0x02, 0x01, 0x00})             // 私有帧
+	f.Add([]byte{0x34, 0x04, 0x14, 0x02, 0x18, 0x00}) // 不完整的 interface
+}
+
+func FuzzDecode(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, target := range fuzzTargets() {
+			d := NewDecoder(bytes.NewReader(data))
+			d.SetMaxFrameSize(fuzzMaxFrameSize)
+			// 每次 Decode 至少消耗一个字节，所以循环次数不会超过输入的长度
+			for i := 0; i <= len(data); i++ {
+				if err := d.Decode(target); err != nil {
+					break
+				}
+			}
+		}
+		_ = Dump(io.Discard, data)
+	})
+}
+
+func FuzzDecodeBytes(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := NewDecoder(bytes.NewReader(nil))
+		for _, target := range fuzzTargets() {
+			_ = d.DecodeBytes(data, target)
+		}
+	})
+}
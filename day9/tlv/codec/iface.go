@@ -0,0 +1,316 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"tlv/core"
+)
+
+// interface 类型的值（interface{} 字段、error、map[string]interface{} 的 value 等）需要自描述，解码端才知道该还原成什么类型：
+//   - nil 编码成 Invalid
+//   - 通过 Register / RegisterName 注册过名字的类型，编码成 Kind 为 Interface 的嵌套 TLV，V 部分是 [类型名的 string TLV][值的 TLV]，
+//     解码时按名字找到类型再解码
+//   - 私有类型（比如 time.Time）本身就带着私有 tag，直接编码，解码时按私有 tag 找到类型
+//   - 没有注册的 error 编码成名字为 "error"、值为 Error() 的 Interface TLV，解码后得到 errors.New(msg)
+//   - 其余的基本类型、切片、数组、map 直接按自身的 Kind 编码，解码时还原成默认类型：
+//     有符号整数是 int64，无符号整数是 uint64，切片和数组是 []interface{}，
+//     map 的 key 全是 string 时是 map[string]interface{}，否则是 map[interface{}]interface{}
+//   - 没有注册的结构体、指针等类型无法还原，编码时直接报错
+// 与 gob.Register 一样，类型名需要在编解码两端都注册
+
+// errorName 没有注册的 error 使用的类型名
+const errorName = "error"
+
+var (
+	namesMu    sync.RWMutex
+	nameToType = map[string]reflect.Type{}
+	typeToName = map[reflect.Type]string{}
+)
+
+// Register 以类型的名字（比如 main.Foo、*main.Foo）注册 value 的类型，之后这种类型的值就可以放在 interface 中编解码了
+func Register(value interface{}) error {
+	typ := reflect.TypeOf(value)
+	if typ == nil {
+		return errors.New("tlv: 不能注册 nil")
+	}
+	return RegisterName(typ.String(), value)
+}
+
+// RegisterName 以 name 注册 value 的类型。同一个名字或者同一个类型只能注册一次
+func RegisterName(name string, value interface{}) error {
+	typ := reflect.TypeOf(value)
+	if name == "" || typ == nil {
+		return fmt.Errorf("tlv: 注册类型名[%s]时名字和类型都不能为空", name)
+	}
+	if name == errorName {
+		return fmt.Errorf("tlv: 类型名[%s]是保留的", name)
+	}
+	namesMu.Lock()
+	defer namesMu.Unlock()
+	if t, ok := nameToType[name]; ok {
+		return fmt.Errorf("tlv: 类型名[%s]已经被 %s 注册过了", name, t)
+	}
+	if n, ok := typeToName[typ]; ok {
+		return fmt.Errorf("tlv: %s 已经以类型名[%s]注册过了", typ, n)
+	}
+	nameToType[name] = typ
+	typeToName[typ] = name
+	return nil
+}
+
+func lookupTypeName(typ reflect.Type) (string, bool) {
+	namesMu.RLock()
+	defer namesMu.RUnlock()
+	name, ok := typeToName[typ]
+	return name, ok
+}
+
+func lookupNamedType(name string) (reflect.Type, bool) {
+	namesMu.RLock()
+	defer namesMu.RUnlock()
+	typ, ok := nameToType[name]
+	return typ, ok
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// interfaceEncOp interface 类型的编码计划，每次编码时根据动态类型找到对应的编码计划
+func interfaceEncOp() *encOp {
+	return &encOp{
+		size: func(s *encState, v reflect.Value) (int, error) {
+			if v.IsNil() {
+				return 2, nil
+			}
+			elem := v.Elem()
+			name, wrap, err := dynamicName(elem.Type())
+			if err != nil {
+				return 0, err
+			}
+			if name == errorName { // 错误信息同样按先序暂存起来，与私有类型共用一个列表
+				msg := elem.Interface().(error).Error()
+				s.private = append(s.private, []byte(msg))
+				inner := tlvSize(core.String, len(name)) + tlvSize(core.String, len(msg))
+				return tlvSize(core.Interface, inner), nil
+			}
+			op, err := encoderOf(elem.Type())
+			if err != nil {
+				return 0, err
+			}
+			if !wrap {
+				return op.size(s, elem)
+			}
+			slot := s.reserveSize()
+			n, err := op.size(s, elem)
+			if err != nil {
+				return 0, err
+			}
+			inner := tlvSize(core.String, len(name)) + n
+			s.sizes[slot] = inner
+			return tlvSize(core.Interface, inner), nil
+		},
+		write: func(s *encState, v reflect.Value) {
+			if v.IsNil() {
+				s.buf = appendTL(s.buf, core.DataTypePrimitive, core.Invalid, 0)
+				return
+			}
+			elem := v.Elem()
+			name, wrap, _ := dynamicName(elem.Type())
+			if name == errorName {
+				msg := s.private[s.privateIdx]
+				s.privateIdx++
+				inner := tlvSize(core.String, len(name)) + tlvSize(core.String, len(msg))
+				s.buf = appendTL(s.buf, core.DataTypeStruct, core.Interface, inner)
+				s.buf = append(appendTL(s.buf, core.DataTypePrimitive, core.String, len(name)), name...)
+				s.buf = append(appendTL(s.buf, core.DataTypePrimitive, core.String, len(msg)), msg...)
+				return
+			}
+			op, _ := encoderOf(elem.Type())
+			if wrap {
+				s.buf = appendTL(s.buf, core.DataTypeStruct, core.Interface, s.nextSize())
+				s.buf = append(appendTL(s.buf, core.DataTypePrimitive, core.String, len(name)), name...)
+			}
+			op.write(s, elem)
+		},
+	}
+}
+
+// dynamicName 决定 interface 中的动态类型怎么编码：wrap 为 true 时需要带上类型名
+func dynamicName(typ reflect.Type) (name string, wrap bool, err error) {
+	if name, ok := lookupTypeName(typ); ok {
+		return name, true, nil
+	}
+	if lookupPrivateType(typ) != nil {
+		return "", false, nil
+	}
+	if typ.Implements(errorType) {
+		return errorName, true, nil
+	}
+	switch typ.Kind() {
+	case reflect.Struct, reflect.Ptr, reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Uintptr:
+		return "", false, fmt.Errorf("tlv: 类型 %s 没有注册，不能作为 interface 的值编码，请先调用 Register", typ)
+	}
+	return "", false, nil
+}
+
+var (
+	anyType       = reflect.TypeOf((*interface{})(nil)).Elem()
+	anySliceType  = reflect.TypeOf([]interface{}(nil))
+	anyMapType    = reflect.TypeOf(map[interface{}]interface{}(nil))
+	stringMapType = reflect.TypeOf(map[string]interface{}(nil))
+	bytesType     = reflect.TypeOf([]byte(nil))
+)
+
+// naturalTypes 没有类型名的 TLV 解码到 interface 中时使用的默认类型
+var naturalTypes = map[core.Kind]reflect.Type{
+	core.Bool:       reflect.TypeOf(false),
+	core.Int:        reflect.TypeOf(int64(0)),
+	core.Int8:       reflect.TypeOf(int64(0)),
+	core.Int16:      reflect.TypeOf(int64(0)),
+	core.Int32:      reflect.TypeOf(int64(0)),
+	core.Int64:      reflect.TypeOf(int64(0)),
+	core.Uint:       reflect.TypeOf(uint64(0)),
+	core.Uint8:      reflect.TypeOf(uint64(0)),
+	core.Uint16:     reflect.TypeOf(uint64(0)),
+	core.Uint32:     reflect.TypeOf(uint64(0)),
+	core.Uint64:     reflect.TypeOf(uint64(0)),
+	core.Float32:    reflect.TypeOf(float32(0)),
+	core.Float64:    reflect.TypeOf(float64(0)),
+	core.Complex64:  reflect.TypeOf(complex64(0)),
+	core.Complex128: reflect.TypeOf(complex128(0)),
+	core.String:     reflect.TypeOf(""),
+	core.Bytes:      bytesType,
+	core.Slice:      anySliceType,
+	core.Array:      anySliceType,
+	core.Map:        anyMapType,
+}
+
+// interfaceDecOp interface 类型的解码计划，先根据 TLV 还原出一个值，再检查它能不能赋给目标的 interface 类型
+func interfaceDecOp() *decOp {
+	op := &decOp{private: true}
+	op.decode = func(data []byte, tag core.Tag, v reflect.Value) error {
+		var res reflect.Value
+		var err error
+		switch {
+		case tag.FrameType == core.FrameTypePrivate:
+			res, err = decodePrivateAny(data, tag)
+		case tag.TagValue == core.Interface:
+			res, err = decodeNamed(data, tag)
+		case tag.TagValue == core.Ptr:
+			if tag.DataType != core.DataTypeStruct { // nil 指针
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			_, err = decodeOne(op, data, v) // 指针解引用之后放进 interface
+			return err
+		default:
+			res, err = decodeNatural(data, tag)
+		}
+		if err != nil {
+			return err
+		}
+		if !res.Type().AssignableTo(v.Type()) {
+			return mismatch(v, tag)
+		}
+		v.Set(res)
+		return nil
+	}
+	return op
+}
+
+func decodePrivateAny(data []byte, tag core.Tag) (reflect.Value, error) {
+	privateMu.RLock()
+	pt := privateByTag[int(tag.TagValue)]
+	privateMu.RUnlock()
+	if pt == nil {
+		return reflect.Value{}, fmt.Errorf("%w: 私有 tag[%d] 没有注册", ErrUnknownTag, tag.TagValue)
+	}
+	res := reflect.New(pt.typ).Elem()
+	if err := privateDecOp(pt).decode(data, tag, res); err != nil {
+		return reflect.Value{}, err
+	}
+	return res, nil
+}
+
+// decodeNamed 解码 [类型名][值] 形式的 TLV
+func decodeNamed(data []byte, tag core.Tag) (reflect.Value, error) {
+	if tag.DataType != core.DataTypeStruct {
+		return reflect.Value{}, &TypeError{Target: anyType, Wire: tag.TagValue}
+	}
+	var name string
+	n, err := decodeOne(stringDecOp, data, reflect.ValueOf(&name).Elem())
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	data = data[n:]
+	if name == errorName {
+		var msg string
+		if _, err = decodeOne(stringDecOp, data, reflect.ValueOf(&msg).Elem()); err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(errors.New(msg)), nil
+	}
+	typ, ok := lookupNamedType(name)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("tlv: 类型名[%s]没有注册", name)
+	}
+	op, err := decoderOf(typ)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	res := reflect.New(typ).Elem()
+	if _, err = decodeOne(op, data, res); err != nil {
+		return reflect.Value{}, err
+	}
+	return res, nil
+}
+
+// decodeNatural 把没有类型名的 TLV 解码成默认类型
+func decodeNatural(data []byte, tag core.Tag) (reflect.Value, error) {
+	typ, ok := naturalTypes[tag.TagValue]
+	if !ok {
+		return reflect.Value{}, &TypeError{Target: anyType, Wire: tag.TagValue}
+	}
+	op, err := decoderOf(typ)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	res := reflect.New(typ).Elem()
+	if err = op.decode(data, tag, res); err != nil {
+		return reflect.Value{}, err
+	}
+	if typ == anyMapType {
+		return stringKeyed(res), nil
+	}
+	return res, nil
+}
+
+// stringKeyed key 全是 string 的 map 转成 map[string]interface{}，这是最常见的用法
+func stringKeyed(m reflect.Value) reflect.Value {
+	if m.IsNil() {
+		return reflect.Zero(stringMapType)
+	}
+	iter := m.MapRange()
+	for iter.Next() {
+		if iter.Key().Elem().Kind() != reflect.String {
+			return m
+		}
+	}
+	res := make(map[string]interface{}, m.Len())
+	iter = m.MapRange()
+	for iter.Next() {
+		res[iter.Key().Elem().String()] = iter.Value().Interface()
+	}
+	return reflect.ValueOf(res)
+}
+
+var stringDecOp = &decOp{
+	decode: func(data []byte, tag core.Tag, v reflect.Value) error {
+		if tag.TagValue != core.String || tag.FrameType != core.FrameTypePrimitive {
+			return mismatch(v, tag)
+		}
+		v.SetString(string(data))
+		return nil
+	},
+}
@@ -0,0 +1,158 @@
+package codec
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+	"tlv/core"
+)
+
+// 私有类型：应用可以为自己的类型（time.Time、decimal、UUID 等）注册一个私有 tag 以及编解码函数，
+// 这种类型会被编码成帧类型为 FrameTypePrivate 的 TLV，V 部分就是编码函数返回的字节，而不是把它拆成一个个结构体字段。
+// 私有 tag 与基本帧的 Kind 是两套编号，互不冲突。
+// 注册需要在编解码之前完成（一般放在 init 中），与 gob.Register 类似
+
+// MarshalFunc 把私有类型的值编码成字节，v 的类型就是注册时的类型
+type MarshalFunc func(v interface{}) ([]byte, error)
+
+// UnmarshalFunc 把字节解码成私有类型的值，返回值的类型必须是注册时的类型
+type UnmarshalFunc func(data []byte) (interface{}, error)
+
+type privateType struct {
+	tag       int
+	typ       reflect.Type
+	marshal   MarshalFunc
+	unmarshal UnmarshalFunc
+}
+
+// TimeTag time.Time 默认注册的私有 tag
+const TimeTag = 1
+
+var (
+	privateMu     sync.RWMutex
+	privateByType = map[reflect.Type]*privateType{}
+	privateByTag  = map[int]*privateType{}
+)
+
+func init() {
+	if err := RegisterBinary(TimeTag, time.Time{}); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterPrivate 以私有 tag 注册 sample 的类型。tag 必须是正整数，同一个 tag 或者同一个类型只能注册一次
+func RegisterPrivate(tag int, sample interface{}, marshal MarshalFunc, unmarshal UnmarshalFunc) error {
+	if tag <= 0 {
+		return fmt.Errorf("tlv: 私有 tag[%d] 必须是正整数", tag)
+	}
+	if sample == nil || marshal == nil || unmarshal == nil {
+		return fmt.Errorf("tlv: 注册私有 tag[%d] 时类型和编解码函数都不能为空", tag)
+	}
+	typ := reflect.TypeOf(sample)
+	privateMu.Lock()
+	if pt, ok := privateByTag[tag]; ok {
+		privateMu.Unlock()
+		return fmt.Errorf("tlv: 私有 tag[%d] 已经被 %s 注册过了", tag, pt.typ)
+	}
+	if pt, ok := privateByType[typ]; ok {
+		privateMu.Unlock()
+		return fmt.Errorf("tlv: %s 已经以私有 tag[%d] 注册过了", typ, pt.tag)
+	}
+	pt := &privateType{tag: tag, typ: typ, marshal: marshal, unmarshal: unmarshal}
+	privateByTag[tag] = pt
+	privateByType[typ] = pt
+	privateMu.Unlock()
+	// 已经生成的编解码计划里可能把这个类型当成普通类型处理了，清空重新生成。
+	// 生成计划时会先拿 encOpsLock 再查注册表，所以这里要先释放 privateMu，避免死锁
+	clearOps()
+	return nil
+}
+
+// RegisterBinary 注册实现了 encoding.BinaryMarshaler 和 encoding.BinaryUnmarshaler（指针接收器）的类型，
+// 比如 time.Time，以及常见的 UUID、decimal 实现
+func RegisterBinary(tag int, sample interface{}) error {
+	typ := reflect.TypeOf(sample)
+	if typ == nil {
+		return fmt.Errorf("tlv: 注册私有 tag[%d] 时类型不能为空", tag)
+	}
+	if !typ.Implements(reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()) ||
+		!reflect.PtrTo(typ).Implements(reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()) {
+		return fmt.Errorf("tlv: %s 没有实现 encoding.BinaryMarshaler 和 encoding.BinaryUnmarshaler", typ)
+	}
+	marshal := func(v interface{}) ([]byte, error) {
+		return v.(encoding.BinaryMarshaler).MarshalBinary()
+	}
+	unmarshal := func(data []byte) (interface{}, error) {
+		p := reflect.New(typ)
+		if err := p.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		return p.Elem().Interface(), nil
+	}
+	return RegisterPrivate(tag, sample, marshal, unmarshal)
+}
+
+func lookupPrivateType(typ reflect.Type) *privateType {
+	privateMu.RLock()
+	defer privateMu.RUnlock()
+	return privateByType[typ]
+}
+
+func clearOps() {
+	encOpsLock.Lock()
+	encOps.Range(func(key, _ interface{}) bool {
+		encOps.Delete(key)
+		return true
+	})
+	encOpsLock.Unlock()
+	decOpsLock.Lock()
+	decOps.Range(func(key, _ interface{}) bool {
+		decOps.Delete(key)
+		return true
+	})
+	decOpsLock.Unlock()
+}
+
+// privateEncOp 私有类型的编码计划。编码函数的结果在 size 趟就得到了，暂存起来给 write 趟用
+func privateEncOp(pt *privateType) *encOp {
+	return &encOp{
+		size: func(s *encState, v reflect.Value) (int, error) {
+			data, err := pt.marshal(v.Interface())
+			if err != nil {
+				return 0, fmt.Errorf("tlv: 编码 %s 失败：%w", pt.typ, err)
+			}
+			s.private = append(s.private, data)
+			return tagSize(pt.tag) + varintSize(len(data)) + len(data), nil
+		},
+		write: func(s *encState, v reflect.Value) {
+			data := s.private[s.privateIdx]
+			s.privateIdx++
+			s.buf = appendTag(s.buf, core.FrameTypePrivate, core.DataTypePrimitive, pt.tag)
+			s.buf = append(appendVarint(s.buf, len(data)), data...)
+		},
+	}
+}
+
+// privateDecOp 私有类型的解码计划，只接受同一个私有 tag 的 TLV
+func privateDecOp(pt *privateType) *decOp {
+	return &decOp{
+		private: true,
+		decode: func(data []byte, tag core.Tag, v reflect.Value) error {
+			if tag.FrameType != core.FrameTypePrivate || int(tag.TagValue) != pt.tag {
+				return mismatch(v, tag)
+			}
+			res, err := pt.unmarshal(data)
+			if err != nil {
+				return fmt.Errorf("tlv: 解码 %s 失败：%w", pt.typ, err)
+			}
+			rv := reflect.ValueOf(res)
+			if !rv.IsValid() || rv.Type() != pt.typ {
+				return fmt.Errorf("tlv: 私有 tag[%d] 的解码函数返回了 %T，期望的是 %s", pt.tag, res, pt.typ)
+			}
+			v.Set(rv)
+			return nil
+		},
+	}
+}
@@ -70,11 +70,16 @@ func buildTag(frameType byte, dataType byte, tagValue Kind) (tagBytes []byte) {
 	return tagBytes
 }
 
+// BuildVarint 生成变长整数的字节数据，编码方式与长度字段相同，结构体的字段编号也用它来编码
+func BuildVarint(value int) []byte {
+	return buildLength(value)
+}
+
 // 生成TLV的数据长度字节数据
 func buildLength(length int) (lenBytes []byte) {
 
 	if length < 0 {
-		fmt.Errorf("长度不能为负数 length = %d\n", length)
+		panic(fmt.Sprintf("长度不能为负数 length = %d", length))
 	}
 
 	if length == 0 {
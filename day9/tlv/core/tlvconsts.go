@@ -32,6 +32,7 @@ const (
 	String
 	Struct
 	UnsafePointer
+	Bytes // []byte 和 [N]byte 不再逐个元素编码，而是直接写入原始字节
 )
 
 // String returns the name of k.
@@ -70,14 +71,15 @@ var kindNames = []string{
 	String:        "string",
 	Struct:        "struct",
 	UnsafePointer: "unsafe.Pointer",
+	Bytes:         "bytes",
 }
 
 var IntKinds = map[Kind]struct{}{
-	Int:   {},
-	Int8:  {},
-	Int16: {},
-	Int32: {},
-	Int64: {},
+	Int:    {},
+	Int8:   {},
+	Int16:  {},
+	Int32:  {},
+	Int64:  {},
 	Uint:   {},
 	Uint8:  {},
 	Uint16: {},
@@ -85,7 +87,6 @@ var IntKinds = map[Kind]struct{}{
 	Uint64: {},
 }
 
-
 // 帧类型
 const (
 	FrameTypePrimitive = 0x00 //基本类型   0000 0000
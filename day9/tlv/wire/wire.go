@@ -0,0 +1,40 @@
+// Package wire geerpc 连接开头的二进制握手的格式。
+// geerpc 和 tlvdump 都用这里的常量，握手的格式只在这里定义一次，两边不会改了一边忘了另一边。
+//
+// 请求：| 魔数（4） | 版本（1） | 长度（2） | 编码方式（1） | 压缩方式（1） | 标志位（1） | 连接超时（8） | 处理超时（8） | 压缩阈值（4） | 编码名长度（1） | 编码名 |
+//
+// 应答：| 魔数（4） | 版本（1） | 长度（2） | 状态（1） | 错误信息 |
+//
+// 详细的说明见 geerpc/handshake.go
+package wire
+
+// 握手的头部
+const (
+	Magic      = 0x3bef5c // 魔数，也就是 geerpc.MagicNumber
+	Version    = 1        // 目前的版本
+	HeaderSize = 7        // 魔数 + 版本 + 长度
+	OptionSize = 24       // 请求内容中编码名之前的部分
+)
+
+// 应答的状态
+const (
+	StatusOK       = 0
+	StatusRejected = 1
+)
+
+// 标志位
+const (
+	FlagFraming = 1 << 0 // 开启分帧
+)
+
+// 内置编码方式的编号，一旦确定就不能再改。通过 codec.Register 注册的编码方式编号为 0，握手时带上编码名
+const (
+	CodecGob     = 1
+	CodecJson    = 2
+	CodecTlv     = 3
+	CodecProto   = 4
+	CodecMsgpack = 5
+)
+
+// TlvType TLV 编码在握手中的编码名，也就是 geerpc/codec.TlvType
+const TlvType = "application/tlv"